@@ -26,11 +26,15 @@ func main() {
 
 	var cf srv.Conf
 	loadConfFromFile(&cf, *configFile)
-	cf.Init()
+	if err := cf.Init(); err != nil {
+		olog.Fatalf("init config failed: %v", err)
+	}
 
 	olog.SetLevel(olog.GetLevelByString(cf.Loglevel))
 
-	srv.NewServer(cf, assets).Start()
+	s := srv.NewServer(cf, assets)
+	s.WatchConfig(*configFile)
+	s.Start()
 }
 
 func loadConfFromFile(cf *srv.Conf, cfFile string) {
@@ -0,0 +1,289 @@
+package srv
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/welllog/olog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// proposal is a pending write under a protected prefix. It is applied only when
+// a second user approves it and the key is still at BaseRevision. Proposals are
+// kept in the memory of the process, replicas do not see each other's.
+type proposal struct {
+	ID           string `json:"id"`
+	Host         string `json:"host"`
+	Op           string `json:"op"`
+	Key          string `json:"key"`
+	Value        string `json:"value,omitempty"`
+	OldValue     string `json:"oldValue,omitempty"`
+	Ttl          int64  `json:"ttl,omitempty"`
+	BaseRevision int64  `json:"baseRevision"`
+	Proposer     string `json:"proposer"`
+	CreatedAt    int64  `json:"createdAt"`
+	proposerSid  string
+}
+
+type proposalStore struct {
+	mu    sync.Mutex
+	items map[string]*proposal
+}
+
+func newProposalStore() *proposalStore {
+	return &proposalStore{items: make(map[string]*proposal, 4)}
+}
+
+func (s *proposalStore) Add(p *proposal) {
+	s.mu.Lock()
+	s.items[p.ID] = p
+	s.mu.Unlock()
+}
+
+func (s *proposalStore) Get(id string) (*proposal, bool) {
+	s.mu.Lock()
+	p, ok := s.items[id]
+	s.mu.Unlock()
+	return p, ok
+}
+
+// Take removes the proposal so that it can be applied or rejected only once.
+func (s *proposalStore) Take(id string) (*proposal, bool) {
+	s.mu.Lock()
+	p, ok := s.items[id]
+	delete(s.items, id)
+	s.mu.Unlock()
+	return p, ok
+}
+
+func (s *proposalStore) List(host string) []*proposal {
+	s.mu.Lock()
+	list := make([]*proposal, 0, len(s.items))
+	for _, p := range s.items {
+		if p.Host == host {
+			list = append(list, p)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(list, func(a, b *proposal) int {
+		return cmp.Compare(a.CreatedAt, b.CreatedAt)
+	})
+	return list
+}
+
+// propose stores a write to a protected key as a pending proposal instead of applying it.
+func (h *v3Handlers) propose(w http.ResponseWriter, r *http.Request, cli *etcdClient, p *proposal, warnings []string) {
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method": r.Method,
+		"host":   cli.Host,
+		"uname":  cli.Username,
+		"key":    p.Key,
+	})
+
+	getRsp, err := cli.Get(r.Context(), p.Key)
+	if err != nil {
+		logger.Warnf("get failed: %v", err)
+		Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	if len(getRsp.Kvs) > 0 {
+		p.BaseRevision = getRsp.Kvs[0].ModRevision
+		p.OldValue = string(getRsp.Kvs[0].Value)
+	} else if p.Op == opDelete {
+		Rsp{"errorCode": 404, "message": "The key does not exist."}.WriteTo(w)
+		return
+	}
+
+	sid, name, host := h.sessionUser(w, r)
+	p.ID = newProposalID()
+	p.Host = host
+	p.Proposer = name
+	p.proposerSid = sid
+	p.CreatedAt = time.Now().Unix()
+	h.proposals.Add(p)
+
+	logger.Infof("proposal %s created by %q", p.ID, name)
+	rsp := Rsp{"status": "pending", "message": "The change is waiting for approval.", "proposal": p}
+	if len(warnings) > 0 {
+		rsp["warnings"] = warnings
+	}
+	rsp.WriteTo(w)
+}
+
+func (h *v3Handlers) Proposals(w http.ResponseWriter, r *http.Request) {
+	_, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	// only the login is checked
+	release()
+
+	_, _, host := h.sessionUser(w, r)
+	Rsp{"proposals": h.proposals.List(host)}.WriteTo(w)
+}
+
+func (h *v3Handlers) ApproveProposal(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	id := r.FormValue("id")
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method":   r.Method,
+		"host":     cli.Host,
+		"uname":    cli.Username,
+		"proposal": id,
+	})
+
+	sid, name, host := h.sessionUser(w, r)
+	p, ok := h.proposals.Get(id)
+	if !ok || p.Host != host {
+		Rsp{"errorCode": 404, "message": "The proposal does not exist."}.WriteTo(w)
+		return
+	}
+
+	// a new session is all it takes to look like another anonymous user
+	if name == "" {
+		Rsp{"errorCode": 403, "message": "Approving requires an etcd user or a client certificate."}.WriteTo(w)
+		return
+	}
+
+	if p.proposerSid == sid || p.Proposer == name {
+		Rsp{"errorCode": 403, "message": "The proposal must be approved by another user."}.WriteTo(w)
+		return
+	}
+
+	if p, ok = h.proposals.Take(id); !ok {
+		Rsp{"errorCode": 404, "message": "The proposal does not exist."}.WriteTo(w)
+		return
+	}
+
+	ctx := r.Context()
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	var op clientv3.Op
+	switch p.Op {
+	case opDelete:
+		op = clientv3.OpDelete(p.Key)
+	default:
+		var opts []clientv3.OpOption
+		if p.Ttl > 0 {
+			leaseResp, err := cli.Grant(ctx, p.Ttl)
+			if err != nil {
+				h.proposals.Add(p)
+				logger.Warnf("grant lease failed: %v", err)
+				Rsp{"errorCode": 500, "message": "grant lease failed: " + err.Error()}.WriteTo(w)
+				return
+			}
+			opts = append(opts, clientv3.WithLease(leaseResp.ID))
+		}
+		op = clientv3.OpPut(p.Key, p.Value, opts...)
+	}
+
+	ops := []clientv3.Op{op}
+	var t *pendingTrash
+	if p.Op == opDelete {
+		kvs, err := readDeleted(ctx, cli.Client, ops)
+		if err == nil {
+			t, err = keepInTrash(ctx, cli.Client, &cf, trashEntry{Key: p.Key, User: name}, kvs)
+		}
+		if err != nil {
+			h.proposals.Add(p)
+			logger.Warnf("keep in trash failed: %v", err)
+			Rsp{"errorCode": 500, "message": err.Error()}.WriteTo(w)
+			return
+		}
+		if t != nil {
+			ops = append(ops, t.op())
+		}
+	}
+	ops = append(ops, clientv3.OpGet(p.Key))
+
+	txnRsp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(p.Key), "=", p.BaseRevision)).
+		Then(ops...).
+		Commit()
+	t.finish(ctx, cli.Client, txnRsp, err)
+	if err != nil {
+		h.proposals.Add(p)
+		logger.Warnf("apply proposal failed: %v", err)
+		Rsp{"errorCode": 500, "message": "apply proposal failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	if !txnRsp.Succeeded {
+		logger.Warnf("proposal is stale, base revision %d changed", p.BaseRevision)
+		Rsp{"errorCode": 409, "message": "The key was modified after revision " +
+			strconv.FormatInt(p.BaseRevision, 10) + ", the proposal is discarded."}.WriteTo(w)
+		return
+	}
+
+	logger.Infof("proposal %s by %q approved by %q", p.ID, p.Proposer, name)
+
+	node := Node{Key: p.Key, Ttl: p.Ttl}
+	if kvs := txnRsp.Responses[len(ops)-1].GetResponseRange().Kvs; len(kvs) > 0 {
+		node.setValue(&cf, kvs[0].Value)
+		node.CreatedIndex = kvs[0].CreateRevision
+		node.ModifiedIndex = kvs[0].ModRevision
+		node.VersionIndex = kvs[0].Version
+	}
+	NodeRsp{Node: node}.WriteTo(w)
+}
+
+func (h *v3Handlers) RejectProposal(w http.ResponseWriter, r *http.Request) {
+	_, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	// only the login is checked
+	release()
+
+	id := r.FormValue("id")
+	_, name, host := h.sessionUser(w, r)
+	p, ok := h.proposals.Get(id)
+	if !ok || p.Host != host {
+		Rsp{"errorCode": 404, "message": "The proposal does not exist."}.WriteTo(w)
+		return
+	}
+
+	h.proposals.Take(id)
+	olog.Infof("proposal %s on %s rejected by %q", id, p.Key, name)
+	Rsp{"status": "ok"}.WriteTo(w)
+}
+
+// sessionUser returns the session id, the etcd user name and the current host of the request.
+func (h *v3Handlers) sessionUser(w http.ResponseWriter, r *http.Request) (sid, name, host string) {
+	sess := h.sessmgr.SessionStart(w, r)
+	sid = sess.SessionID()
+	if v, ok := sess.Get("host"); ok {
+		host = v.(string)
+		if info, ok := sess.Get(host); ok {
+			name = info.(*userInfo).Name
+		}
+	}
+	// users sharing an etcd account are told apart by their client certificates
+	if id := certIdentity(r.Context()); id != "" {
+		name = id
+	}
+	return
+}
+
+func newProposalID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,257 @@
+package srv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// maxDecodedSize limits decompressed values so that a malicious value can not exhaust memory.
+const maxDecodedSize = 64 * MB
+
+// Codec converts a stored value into an editable text form and back.
+type Codec interface {
+	Decode(b []byte) ([]byte, error)
+	Encode(b []byte) ([]byte, error)
+}
+
+// CodecFactory creates a codec from its configuration.
+type CodecFactory func(cc CodecConf) (Codec, error)
+
+var codecs = make(map[string]CodecFactory)
+
+// RegisterCodec makes a codec available by the provided name.
+// If RegisterCodec is called twice with the same name or if factory is nil,
+// it panics.
+func RegisterCodec(name string, factory CodecFactory) {
+	if factory == nil {
+		panic("srv: RegisterCodec factory is nil")
+	}
+	if _, dup := codecs[name]; dup {
+		panic("srv: RegisterCodec called twice for codec " + name)
+	}
+	codecs[name] = factory
+}
+
+func newCodec(cc CodecConf) (Codec, error) {
+	factory, ok := codecs[cc.Codec]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", cc.Codec)
+	}
+	return factory(cc)
+}
+
+// encodeStored encodes value with the codec configured for key, if any.
+func (e *Etcd) encodeStored(key, value string) (string, error) {
+	name, c, ok := e.CodecFor(key)
+	if !ok {
+		return value, nil
+	}
+
+	b, err := c.Encode([]byte(value))
+	if err != nil {
+		return "", fmt.Errorf("encode with %s: %w", name, err)
+	}
+	return string(b), nil
+}
+
+// decodeStored decodes value with the codec configured for key, values the codec
+// fails to decode are returned as stored.
+func (e *Etcd) decodeStored(key string, value []byte) string {
+	if _, c, ok := e.CodecFor(key); ok {
+		if b, err := c.Decode(value); err == nil {
+			return string(b)
+		}
+	}
+	return string(value)
+}
+
+type prefixCodec struct {
+	prefix string
+	name   string
+	codec  Codec
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Decode(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readLimited(r)
+}
+
+func (gzipCodec) Encode(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type zstdCodec struct {
+	dec *zstd.Decoder
+	enc *zstd.Encoder
+}
+
+// zstdCoders are shared by the zstd codecs of every configuration, a reload would
+// otherwise leave the decoders and encoders of the old one to be closed. DecodeAll
+// and EncodeAll are safe for concurrent use.
+var zstdCoders = sync.OnceValues(func() (zstdCodec, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+	if err != nil {
+		return zstdCodec{}, err
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		dec.Close()
+		return zstdCodec{}, err
+	}
+	return zstdCodec{dec: dec, enc: enc}, nil
+})
+
+func newZstdCodec(CodecConf) (Codec, error) {
+	return zstdCoders()
+}
+
+func (c zstdCodec) Decode(b []byte) ([]byte, error) {
+	return c.dec.DecodeAll(b, nil)
+}
+
+func (c zstdCodec) Encode(b []byte) ([]byte, error) {
+	return c.enc.EncodeAll(b, nil), nil
+}
+
+// snappyCodec uses the snappy block format.
+type snappyCodec struct{}
+
+func (snappyCodec) Decode(b []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxDecodedSize {
+		return nil, errors.New("decoded value too large")
+	}
+	return snappy.Decode(nil, b)
+}
+
+func (snappyCodec) Encode(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+// msgpackCodec shows MessagePack values as indented JSON. Values JSON can not
+// represent, like bin and ext, fail to decode so that they are kept as stored.
+type msgpackCodec struct{}
+
+var errMsgpackBinary = errors.New("msgpack bin values can not be shown as JSON")
+
+func (msgpackCodec) Decode(b []byte) ([]byte, error) {
+	var v any
+	if err := msgpack.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	if hasBinary(v) {
+		return nil, errMsgpackBinary
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// hasBinary reports whether v holds a bin value, which JSON would turn into a string.
+func hasBinary(v any) bool {
+	switch t := v.(type) {
+	case []byte:
+		return true
+	case map[string]any:
+		for _, e := range t {
+			if hasBinary(e) {
+				return true
+			}
+		}
+	case []any:
+		for _, e := range t {
+			if hasBinary(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (msgpackCodec) Encode(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	// the JSON lost the order of the keys, sorting them keeps the value unchanged
+	// when it is saved as it was shown
+	enc.SetSortMapKeys(true)
+	if err := enc.Encode(jsonNumbers(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonNumbers converts json.Number to int64 when possible and float64 otherwise,
+// so that integers keep their MessagePack type.
+func jsonNumbers(v any) any {
+	switch t := v.(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]any:
+		for k, e := range t {
+			t[k] = jsonNumbers(e)
+		}
+	case []any:
+		for i, e := range t {
+			t[i] = jsonNumbers(e)
+		}
+	}
+	return v
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxDecodedSize {
+		return nil, errors.New("decoded value too large")
+	}
+	return b, nil
+}
+
+func init() {
+	RegisterCodec("gzip", func(CodecConf) (Codec, error) { return gzipCodec{}, nil })
+	RegisterCodec("zstd", newZstdCodec)
+	RegisterCodec("snappy", func(CodecConf) (Codec, error) { return snappyCodec{}, nil })
+	RegisterCodec("msgpack", func(CodecConf) (Codec, error) { return msgpackCodec{}, nil })
+	RegisterCodec("protobuf", newProtobufCodec)
+}
@@ -0,0 +1,107 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufCodec shows protobuf messages as JSON. The message type is looked up in a
+// FileDescriptorSet, as produced by protoc --include_imports --descriptor_set_out.
+// Messages with fields unknown to the descriptor set fail to decode, JSON would
+// drop the fields and saving the value would lose them.
+type protobufCodec struct {
+	desc protoreflect.MessageDescriptor
+}
+
+func newProtobufCodec(cc CodecConf) (Codec, error) {
+	if cc.DescriptorSet == "" || cc.Message == "" {
+		return nil, errors.New("descriptorSet and message are required")
+	}
+
+	b, err := os.ReadFile(cc.DescriptorSet)
+	if err != nil {
+		return nil, err
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("parse descriptor set: %w", err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("load descriptor set: %w", err)
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(cc.Message))
+	if err != nil {
+		return nil, fmt.Errorf("find message %s: %w", cc.Message, err)
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", cc.Message)
+	}
+	return protobufCodec{desc: md}, nil
+}
+
+func (c protobufCodec) Decode(b []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(c.desc)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	if hasUnknownFields(msg) {
+		return nil, errUnknownFields
+	}
+	return protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(msg)
+}
+
+var errUnknownFields = errors.New("the message has fields unknown to the descriptor set")
+
+// hasUnknownFields reports whether m or any message nested in it has unknown fields.
+func hasUnknownFields(m protoreflect.Message) bool {
+	if len(m.GetUnknown()) > 0 {
+		return true
+	}
+
+	unknown := false
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+					unknown = hasUnknownFields(v.Message())
+					return !unknown
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				l := v.List()
+				for i := 0; i < l.Len() && !unknown; i++ {
+					unknown = hasUnknownFields(l.Get(i).Message())
+				}
+			}
+		case fd.Message() != nil:
+			unknown = hasUnknownFields(v.Message())
+		}
+		return !unknown
+	})
+	return unknown
+}
+
+func (c protobufCodec) Encode(b []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(c.desc)
+	if err := protojson.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	// fields of dynamic messages are marshaled in random order otherwise
+	return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+}
@@ -0,0 +1,161 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// writeDescriptorSet writes the descriptor set of acme.Config
+// {string name = 1; int32 port = 2; repeated acme.Item items = 3;} and acme.Item {string id = 1;}.
+func writeDescriptorSet(t *testing.T) string {
+	t.Helper()
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(num),
+			Type:     typ.Enum(),
+			Label:    label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("acme.proto"),
+		Package: proto.String("acme"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Config"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("port", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, optional, ""),
+					field("items", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, descriptorpb.FieldDescriptorProto_LABEL_REPEATED, ".acme.Item"),
+				},
+			},
+			{
+				Name:  proto.String("Item"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, "")},
+			},
+		},
+	}}}
+
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "acme.pb")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestCodec(t *testing.T, cc CodecConf) Codec {
+	t.Helper()
+	c, err := newCodec(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestCodecRoundTrip checks that saving a decoded value unchanged stores the
+// bytes it was decoded from.
+func TestCodecRoundTrip(t *testing.T) {
+	desc := writeDescriptorSet(t)
+
+	tests := []struct {
+		cc   CodecConf
+		text string
+	}{
+		{cc: CodecConf{Codec: "gzip"}, text: "a = 1\nb = 2\n"},
+		{cc: CodecConf{Codec: "zstd"}, text: "a = 1\nb = 2\n"},
+		{cc: CodecConf{Codec: "snappy"}, text: "a = 1\nb = 2\n"},
+		{cc: CodecConf{Codec: "msgpack"}, text: `{"a": 1, "b": [true, null, "s", -300, 1.5, 0.1], "c": {"d": 1e100}}`},
+		{cc: CodecConf{Codec: "protobuf", DescriptorSet: desc, Message: "acme.Config"}, text: `{"name": "web", "port": 8080, "items": [{"id": "a"}, {}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cc.Codec, func(t *testing.T) {
+			c := newTestCodec(t, tt.cc)
+			stored, err := c.Encode([]byte(tt.text))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text, err := c.Decode(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := c.Encode(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, stored) {
+				t.Errorf("encode(decode(x)) = %x, want %x\ndecoded:\n%s", again, stored, text)
+			}
+		})
+	}
+}
+
+func TestMsgpackBinary(t *testing.T) {
+	for _, v := range []any{
+		[]byte{0, 1, 2},
+		map[string]any{"a": []any{1, []byte("x")}},
+	} {
+		b, err := msgpack.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (msgpackCodec{}).Decode(b); !errors.Is(err, errMsgpackBinary) {
+			t.Errorf("decode %v: err = %v, want %v", v, err, errMsgpackBinary)
+		}
+	}
+}
+
+func TestProtobufUnknownFields(t *testing.T) {
+	c := newTestCodec(t, CodecConf{Codec: "protobuf", DescriptorSet: writeDescriptorSet(t), Message: "acme.Config"})
+	item := protowire.AppendTag(nil, 1, protowire.BytesType)
+	item = protowire.AppendString(item, "a")
+
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{
+			name:  "top level",
+			value: protowire.AppendVarint(protowire.AppendTag(nil, 9, protowire.VarintType), 1),
+		},
+		{
+			name: "nested",
+			value: protowire.AppendBytes(protowire.AppendTag(nil, 3, protowire.BytesType),
+				protowire.AppendVarint(protowire.AppendTag(item, 9, protowire.VarintType), 1)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.Decode(tt.value); !errors.Is(err, errUnknownFields) {
+				t.Errorf("err = %v, want %v", err, errUnknownFields)
+			}
+		})
+	}
+
+	known := protowire.AppendBytes(protowire.AppendTag(nil, 3, protowire.BytesType), item)
+	if _, err := c.Decode(known); err != nil {
+		t.Errorf("decode known fields: %v", err)
+	}
+}
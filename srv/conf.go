@@ -1,15 +1,94 @@
 package srv
 
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/welllog/olog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gopkg.in/yaml.v3"
+)
+
 type Etcd struct {
-	Endpoints string `yaml:"endpoints"`
+	Endpoints Endpoints `yaml:"endpoints"`
+	// Name identifies the cluster, it defaults to the endpoints.
 	Name      string `yaml:"name"`
 	Separator string `yaml:"separator"`
-	Tls       struct {
+	// AutoSyncInterval is the number of seconds between updates of the endpoints
+	// from the cluster members, 0 disables it.
+	AutoSyncInterval int `yaml:"autoSyncInterval"`
+	// Protected lists key prefixes whose writes must be approved by a second user.
+	Protected []string `yaml:"protected"`
+	// Codecs decode values under a prefix for display and encode them back on write.
+	Codecs []CodecConf `yaml:"codecs"`
+	// Schemas validate values written under a prefix.
+	Schemas []SchemaConf `yaml:"schemas"`
+	// Formats declare the syntax of values under a prefix, keys without one are
+	// detected by their extension.
+	Formats []FormatConf `yaml:"formats"`
+	// Policies are evaluated before writes and may deny them or warn the user.
+	Policies []PolicyConf `yaml:"policies"`
+	// Webhooks are notified of changes under a prefix, made by any client.
+	Webhooks []WebhookConf `yaml:"webhooks"`
+	// Trash keeps deleted keys for a while so that deletes can be undone.
+	Trash TrashConf `yaml:"trash"`
+	// KubernetesPrefix is the --etcd-prefix of kube-apiserver. The objects it
+	// writes under the prefix are decoded for display and are read-only.
+	KubernetesPrefix string `yaml:"kubernetesPrefix"`
+	Tls              struct {
 		Enable        bool   `yaml:"enable"`
 		CertFile      string `yaml:"certFile"`
 		KeyFile       string `yaml:"keyFile"`
 		TrustedCAFile string `yaml:"trustedCAFile"`
 	} `yaml:"tls"`
+	// tlsFiles are the versions of the TLS files when the config was loaded, a
+	// reload reconnects the clients when they were replaced.
+	tlsFiles [3]fileVersion
+	codecs   []prefixCodec
+	schemas  []prefixSchema
+	policies []policy
+}
+
+// Endpoints are the client URLs of a cluster, configured as a list or as a comma
+// separated string.
+type Endpoints []string
+
+func (e *Endpoints) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*e = splitEndpoints(value.Value)
+		return nil
+	}
+
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*e = list
+	return nil
+}
+
+func (e Endpoints) String() string {
+	return strings.Join(e, ",")
+}
+
+func splitEndpoints(s string) Endpoints {
+	var e Endpoints
+	for _, ep := range strings.Split(s, ",") {
+		if ep = strings.TrimSpace(ep); ep != "" {
+			e = append(e, ep)
+		}
+	}
+	return e
+}
+
+type CodecConf struct {
+	Prefix string `yaml:"prefix"`
+	Codec  string `yaml:"codec"`
+	// DescriptorSet and Message describe the message type of the protobuf codec.
+	DescriptorSet string `yaml:"descriptorSet"`
+	Message       string `yaml:"message"`
 }
 
 type Conf struct {
@@ -18,22 +97,108 @@ type Conf struct {
 	Debug    bool   `yaml:"debug"`
 	Loglevel string `yaml:"loglevel"`
 	Etcds    []Etcd `yaml:"etcds"`
-	etcds    map[string]Etcd
+	// Tls serves etcdkeeper over HTTPS.
+	Tls ServerTls `yaml:"tls"`
+	// WebhookDeadLetter is the file undeliverable webhook events are appended to.
+	WebhookDeadLetter string `yaml:"webhookDeadLetter"`
+	// MaxClients limits the etcd clients kept for logged in users, one per host and
+	// user, the least recently used are closed first.
+	MaxClients int `yaml:"maxClients"`
+	// HealthCheckInterval is the number of seconds between health checks of the
+	// clients, broken clients are closed and reconnected on the next request.
+	HealthCheckInterval int `yaml:"healthCheckInterval"`
+	// Session selects where login sessions are kept.
+	Session SessionConf       `yaml:"session"`
+	etcds   map[string]Etcd   // by name
+	names   map[string]string // cluster names by endpoints
+}
+
+// SessionConf configures the session provider.
+type SessionConf struct {
+	// Provider is memory (default), file or etcd. File sessions survive restarts,
+	// etcd sessions are shared by replicas.
+	Provider string `yaml:"provider"`
+	// Options of the provider, file takes dir, etcd takes endpoints, username,
+	// password, certFile, keyFile, trustedCAFile and prefix.
+	Options map[string]string `yaml:"options"`
+	// Key encrypts the etcd passwords in sessions, a base64 encoded 32 byte AES key.
+	// Without it a random key is used and sessions can not reconnect to etcd after
+	// a restart or on other replicas.
+	Key string `yaml:"key"`
+	// Secure restricts the session cookies to HTTPS, it is set when tls is enabled.
+	Secure bool `yaml:"secure"`
+	// SameSite of the session cookies: lax (default), strict or none.
+	SameSite string `yaml:"sameSite"`
 }
 
-func (c *Conf) Init() {
+func (s SessionConf) sameSite() http.SameSite {
+	switch s.SameSite {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+func (c *Conf) Init() error {
 	c.Default()
+	switch c.Session.SameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.Session.Secure {
+			return errors.New("session: sameSite none requires secure cookies")
+		}
+	default:
+		return fmt.Errorf("session: unknown sameSite %q", c.Session.SameSite)
+	}
+	if c.Session.Provider == "etcd" && c.Session.Key == "" {
+		// with a random key every replica has its own, so sessions are not shared
+		return errors.New("session: provider etcd requires a key")
+	}
+
 	c.etcds = make(map[string]Etcd, len(c.Etcds))
-	for _, v := range c.Etcds {
-		c.etcds[v.Endpoints] = v
+	c.names = make(map[string]string, len(c.Etcds))
+	for i := range c.Etcds {
+		if err := c.Etcds[i].init(); err != nil {
+			return fmt.Errorf("etcd %s: %w", c.Etcds[i].Name, err)
+		}
+		if _, ok := c.etcds[c.Etcds[i].Name]; ok {
+			// configs that predate cluster names may repeat one, fall back to the
+			// endpoints so they still start
+			endpoints := c.Etcds[i].Endpoints.String()
+			if _, ok := c.etcds[endpoints]; ok {
+				return fmt.Errorf("etcd %s: duplicate name", c.Etcds[i].Name)
+			}
+			olog.Warnf("etcd %s: duplicate name, named %s instead", c.Etcds[i].Name, endpoints)
+			c.Etcds[i].Name = endpoints
+		}
+		c.etcds[c.Etcds[i].Name] = c.Etcds[i]
+		c.names[c.Etcds[i].Endpoints.String()] = c.Etcds[i].Name
 	}
+	return nil
 }
 
-func (c *Conf) GetEtcdConfig(endpoints string) (Etcd, bool) {
-	cf, ok := c.etcds[endpoints]
+// GetEtcdConfig returns the config of the cluster named host. Hosts that are the
+// endpoints of a configured cluster, as sent before clusters had names, find it too.
+func (c *Conf) GetEtcdConfig(host string) (Etcd, bool) {
+	cf, ok := c.etcds[c.ClusterName(host)]
 	return cf, ok
 }
 
+// ClusterName returns the name of the cluster host refers to, or host itself if it
+// is not configured but a list of endpoints.
+func (c *Conf) ClusterName(host string) string {
+	if _, ok := c.etcds[host]; ok {
+		return host
+	}
+	if name, ok := c.names[host]; ok {
+		return name
+	}
+	return host
+}
+
 func (c *Conf) Default() {
 	if c.Host == "" {
 		c.Host = "0.0.0.0"
@@ -43,11 +208,31 @@ func (c *Conf) Default() {
 		c.Port = 8010
 	}
 
+	if c.MaxClients <= 0 {
+		c.MaxClients = 100
+	}
+
+	if c.HealthCheckInterval <= 0 {
+		c.HealthCheckInterval = 30
+	}
+
+	if c.Session.Provider == "" {
+		c.Session.Provider = "memory"
+	}
+
+	if c.Session.SameSite == "" {
+		c.Session.SameSite = "lax"
+	}
+
+	if c.Tls.Enable {
+		c.Session.Secure = true
+	}
+
 	if len(c.Etcds) == 0 {
 		c.Etcds = []Etcd{{}}
 		for i := range c.Etcds {
 			c.Etcds[i].Default()
-			c.Etcds[i].Endpoints = "127.0.0.1:2379"
+			c.Etcds[i].Endpoints = Endpoints{"127.0.0.1:2379"}
 			c.Etcds[i].Name = "default"
 		}
 	} else {
@@ -57,8 +242,102 @@ func (c *Conf) Default() {
 	}
 }
 
+// IsProtected reports whether writes to key require approval.
+func (e *Etcd) IsProtected(key string) bool {
+	for _, p := range e.Protected {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// OverlapsProtected reports whether the key range [from, end) touches a protected
+// prefix. An empty end means the single key from, "\x00" means all keys >= from.
+func (e *Etcd) OverlapsProtected(from, end string) bool {
+	if end == "" {
+		return e.IsProtected(from)
+	}
+
+	for _, p := range e.Protected {
+		if rangeOverlapsPrefix(from, end, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeOverlapsPrefix reports whether the key range [from, end) contains a key
+// with prefix p, "\x00" as end means all keys >= from.
+func rangeOverlapsPrefix(from, end, p string) bool {
+	pend := clientv3.GetPrefixRangeEnd(p)
+	return (pend == "\x00" || from < pend) && (end == "\x00" || end > p)
+}
+
+// CodecFor returns the codec of the longest configured prefix of key.
+func (e *Etcd) CodecFor(key string) (string, Codec, bool) {
+	var found *prefixCodec
+	for i := range e.codecs {
+		pc := &e.codecs[i]
+		if strings.HasPrefix(key, pc.prefix) && (found == nil || len(pc.prefix) > len(found.prefix)) {
+			found = pc
+		}
+	}
+
+	if found == nil {
+		return "", nil, false
+	}
+	return found.name, found.codec, true
+}
+
+func (e *Etcd) init() error {
+	if e.Tls.Enable {
+		// missing files fail when clients connect
+		for i, file := range []string{e.Tls.CertFile, e.Tls.KeyFile, e.Tls.TrustedCAFile} {
+			if file != "" {
+				e.tlsFiles[i], _ = statFileVersion(file)
+			}
+		}
+	}
+
+	e.codecs = make([]prefixCodec, 0, len(e.Codecs))
+	for _, cc := range e.Codecs {
+		c, err := newCodec(cc)
+		if err != nil {
+			return fmt.Errorf("codec %s for %s: %w", cc.Codec, cc.Prefix, err)
+		}
+		e.codecs = append(e.codecs, prefixCodec{prefix: cc.Prefix, name: cc.Codec, codec: c})
+	}
+
+	e.schemas = make([]prefixSchema, 0, len(e.Schemas))
+	for _, sc := range e.Schemas {
+		s, err := compileSchema(sc)
+		if err != nil {
+			return fmt.Errorf("schema %s for %s: %w", sc.File, sc.Prefix, err)
+		}
+		e.schemas = append(e.schemas, prefixSchema{prefix: sc.Prefix, schema: s})
+	}
+
+	e.policies = make([]policy, 0, len(e.Policies))
+	for _, pc := range e.Policies {
+		p, err := compilePolicy(pc)
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", pc.Name, err)
+		}
+		e.policies = append(e.policies, p)
+	}
+	return nil
+}
+
 func (e *Etcd) Default() {
+	if e.Name == "" {
+		e.Name = e.Endpoints.String()
+	}
 	if e.Separator == "" {
 		e.Separator = "/"
 	}
+	if e.KubernetesPrefix == "" {
+		e.KubernetesPrefix = kubernetesPrefix
+	}
+	e.Trash.Default()
 }
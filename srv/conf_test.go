@@ -0,0 +1,45 @@
+package srv
+
+import (
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestEndpointsUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    Endpoints
+		invalid bool
+	}{
+		{name: "scalar", yaml: "endpoints: 127.0.0.1:2379", want: Endpoints{"127.0.0.1:2379"}},
+		{name: "comma separated", yaml: "endpoints: 127.0.0.1:2379, 127.0.0.1:22379 ,", want: Endpoints{"127.0.0.1:2379", "127.0.0.1:22379"}},
+		{name: "list", yaml: "endpoints: [127.0.0.1:2379, https://etcd:2379]", want: Endpoints{"127.0.0.1:2379", "https://etcd:2379"}},
+		{name: "block list", yaml: "endpoints:\n  - 127.0.0.1:2379\n  - 127.0.0.1:22379\n", want: Endpoints{"127.0.0.1:2379", "127.0.0.1:22379"}},
+		{name: "empty", yaml: "endpoints: ", want: nil},
+		{name: "map", yaml: "endpoints: {a: b}", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e struct {
+				Endpoints Endpoints `yaml:"endpoints"`
+			}
+			err := yaml.Unmarshal([]byte(tt.yaml), &e)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("got %q, want an error", e.Endpoints)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(e.Endpoints, tt.want) {
+				t.Errorf("got %q, want %q", e.Endpoints, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package srv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/welllog/olog"
+)
+
+// credentialCipher encrypts the etcd passwords kept in sessions with AES-256-GCM,
+// so sessions only hold passwords that are useless without the key.
+type credentialCipher struct {
+	aead cipher.AEAD
+	// macKey derives the CSRF tokens of sessions, it is derived from the key.
+	macKey []byte
+}
+
+// newCredentialCipher uses the base64 encoded 32 byte key, or a random key if it
+// is empty. Sessions encrypted with a random key can not reconnect after a
+// restart or on other replicas, their users have to log in again.
+func newCredentialCipher(key string) (*credentialCipher, error) {
+	var k []byte
+	if key == "" {
+		k = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, k); err != nil {
+			return nil, err
+		}
+		olog.Info("no session key configured, a random one is used")
+	} else {
+		var err error
+		k, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("decode session key: %w", err)
+		}
+		if len(k) != 32 {
+			return nil, errors.New("session key must be 32 bytes")
+		}
+	}
+
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, k)
+	mac.Write([]byte("csrf"))
+	return &credentialCipher{aead: aead, macKey: mac.Sum(nil)}, nil
+}
+
+// csrfToken returns the CSRF token of the session sid. Replicas sharing the key
+// derive the same token, so it does not have to be stored in the session.
+func (c *credentialCipher) csrfToken(sid string) string {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(sid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts the password of the user logged in to host. The host and the user
+// name are authenticated with it, so the secret can not be moved to another login.
+func (c *credentialCipher) seal(host, name, passwd string) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(passwd)+c.aead.Overhead())
+	_, _ = rand.Read(nonce)
+	return c.aead.Seal(nonce, nonce, []byte(passwd), credentialAD(host, name))
+}
+
+// open decrypts the password of a login.
+func (c *credentialCipher) open(u *userInfo) (string, error) {
+	if len(u.Secret) < c.aead.NonceSize() {
+		return "", errors.New("invalid session secret")
+	}
+
+	nonce, sealed := u.Secret[:c.aead.NonceSize()], u.Secret[c.aead.NonceSize():]
+	b, err := c.aead.Open(nil, nonce, sealed, credentialAD(u.Host, u.Name))
+	if err != nil {
+		return "", fmt.Errorf("decrypt session secret: %w", err)
+	}
+	return string(b), nil
+}
+
+func credentialAD(host, name string) []byte {
+	return []byte(host + "\x00" + name)
+}
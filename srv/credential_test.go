@@ -0,0 +1,62 @@
+package srv
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestCredentialCipher(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	c, err := newCredentialCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newCredentialCipher(base64.StdEncoding.EncodeToString([]byte(strings.Repeat("o", 32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := c.seal("127.0.0.1:2379", "alice", "pw")
+	tests := []struct {
+		name    string
+		cipher  *credentialCipher
+		u       userInfo
+		invalid bool
+	}{
+		{name: "same login", cipher: c, u: userInfo{Host: "127.0.0.1:2379", Name: "alice", Secret: secret}},
+		{name: "wrong host", cipher: c, u: userInfo{Host: "127.0.0.1:22379", Name: "alice", Secret: secret}, invalid: true},
+		{name: "wrong name", cipher: c, u: userInfo{Host: "127.0.0.1:2379", Name: "bob", Secret: secret}, invalid: true},
+		{name: "host and name shifted", cipher: c, u: userInfo{Host: "127.0.0.1:2379\x00alice", Secret: secret}, invalid: true},
+		{name: "other key", cipher: other, u: userInfo{Host: "127.0.0.1:2379", Name: "alice", Secret: secret}, invalid: true},
+		{name: "tampered", cipher: c, u: userInfo{Host: "127.0.0.1:2379", Name: "alice", Secret: append(secret[:len(secret)-1:len(secret)-1], secret[len(secret)-1]^1)}, invalid: true},
+		{name: "short", cipher: c, u: userInfo{Host: "127.0.0.1:2379", Name: "alice", Secret: secret[:4]}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passwd, err := tt.cipher.open(&tt.u)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("opened %q, want an error", passwd)
+				}
+				return
+			}
+			if err != nil || passwd != "pw" {
+				t.Errorf("open = %q, %v, want pw", passwd, err)
+			}
+		})
+	}
+
+	if again := c.seal("127.0.0.1:2379", "alice", "pw"); string(again) == string(secret) {
+		t.Error("sealing twice gave the same secret, the nonce is not random")
+	}
+}
+
+func TestNewCredentialCipherKey(t *testing.T) {
+	for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := newCredentialCipher(key); err == nil {
+			t.Errorf("key %q accepted", key)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package srv
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/welllog/etcdkeeper-v3/srv/session"
+	"github.com/welllog/olog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// maxTxnOps is the default --max-txn-ops of etcd.
+	maxTxnOps = 128
+	// maxDraftOps keeps a draft committable in a single transaction, which also
+	// writes the trash entry of its deletes.
+	maxDraftOps = maxTxnOps - 1
+)
+
+// draftOp is a staged change of a single key. BaseRevision is the mod revision
+// of the key when it was first staged, 0 if the key did not exist.
+type draftOp struct {
+	Op           string `json:"op"`
+	Key          string `json:"key"`
+	Value        string `json:"value,omitempty"`
+	OldValue     string `json:"oldValue,omitempty"`
+	BaseRevision int64  `json:"baseRevision"`
+	Stale        bool   `json:"stale,omitempty"`
+}
+
+// draft is the changeset a user stages per host in the session.
+type draft struct {
+	Ops []draftOp
+}
+
+func draftSessionKey(host string) string {
+	return "draft@" + host
+}
+
+func (h *v3Handlers) getDraft(sess session.Session) (string, draft) {
+	var d draft
+	host, ok := sess.Get("host")
+	if !ok {
+		return "", d
+	}
+
+	if v, ok := sess.Get(draftSessionKey(host.(string))); ok {
+		d = *v.(*draft)
+		d.Ops = slices.Clone(d.Ops)
+	}
+	return host.(string), d
+}
+
+func (h *v3Handlers) Draft(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	_, d := h.getDraft(h.sessmgr.SessionStart(w, r))
+	ctx := r.Context()
+	for i := range d.Ops {
+		getRsp, err := cli.Get(ctx, d.Ops[i].Key, clientv3.WithKeysOnly())
+		if err != nil {
+			Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+			return
+		}
+
+		var rev int64
+		if len(getRsp.Kvs) > 0 {
+			rev = getRsp.Kvs[0].ModRevision
+		}
+		d.Ops[i].Stale = rev != d.Ops[i].BaseRevision
+	}
+
+	Rsp{"ops": d.Ops, "total": len(d.Ops)}.WriteTo(w)
+}
+
+func (h *v3Handlers) DraftPut(w http.ResponseWriter, r *http.Request) {
+	h.stage(w, r, opPut)
+}
+
+func (h *v3Handlers) DraftDel(w http.ResponseWriter, r *http.Request) {
+	h.stage(w, r, opDelete)
+}
+
+func (h *v3Handlers) stage(w http.ResponseWriter, r *http.Request, op string) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	key := r.FormValue("key")
+	value := r.FormValue("value")
+
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method": r.Method,
+		"host":   cli.Host,
+		"uname":  cli.Username,
+		"key":    key,
+	})
+
+	logger.Debugf("DRAFT %s v3", op)
+
+	if key == "" {
+		Rsp{"errorCode": 500, "message": "The key is required."}.WriteTo(w)
+		return
+	}
+
+	value, err := decodeValue(value, r.FormValue("encoding"))
+	if err != nil {
+		Rsp{"errorCode": 400, "message": "decode value failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	raw := r.FormValue("raw") == "true"
+	var warnings []string
+	if cf.IsProtected(key) {
+		Rsp{"errorCode": 403, "message": "Protected keys can not be staged, they must be changed through approval."}.WriteTo(w)
+		return
+	}
+
+	if op == opPut {
+		if ro, err := isKubernetesObject(r.Context(), cli.Client, &cf, key); err != nil {
+			logger.Warnf("get failed: %v", err)
+			Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+			return
+		} else if ro {
+			Rsp{"errorCode": 403, "message": "Kubernetes objects are read-only."}.WriteTo(w)
+			return
+		}
+
+		value, warnings, err = cf.checkValue(key, value, r.FormValue("format"), r.FormValue("normalize"), raw)
+		if err != nil {
+			writeErrRsp(w, 422, err)
+			return
+		}
+	}
+
+	if op == opPut && !raw {
+		value, err = cf.encodeStored(key, value)
+		if err != nil {
+			Rsp{"errorCode": 400, "message": err.Error()}.WriteTo(w)
+			return
+		}
+	}
+
+	sess := h.sessmgr.SessionStart(w, r)
+	host, d := h.getDraft(sess)
+
+	idx, found := slices.BinarySearchFunc(d.Ops, key, func(o draftOp, k string) int {
+		return strings.Compare(o.Key, k)
+	})
+	if found {
+		d.Ops[idx].Op = op
+		d.Ops[idx].Value = value
+	} else {
+		if len(d.Ops) >= maxDraftOps {
+			Rsp{"errorCode": 400, "message": "The draft is full, it can hold " + strconv.Itoa(maxDraftOps) + " keys. Commit or discard it first."}.WriteTo(w)
+			return
+		}
+
+		getRsp, err := cli.Get(r.Context(), key)
+		if err != nil {
+			logger.Warnf("get failed: %v", err)
+			Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+			return
+		}
+
+		o := draftOp{Op: op, Key: key, Value: value}
+		if len(getRsp.Kvs) > 0 {
+			o.BaseRevision = getRsp.Kvs[0].ModRevision
+			o.OldValue = string(getRsp.Kvs[0].Value)
+		} else if op == opDelete {
+			Rsp{"errorCode": 404, "message": "The key does not exist."}.WriteTo(w)
+			return
+		}
+		d.Ops = slices.Insert(d.Ops, idx, o)
+	}
+
+	if op == opDelete {
+		d.Ops[idx].Value = ""
+	}
+
+	_ = sess.Set(draftSessionKey(host), &d)
+	rsp := Rsp{"status": "ok", "total": len(d.Ops)}
+	if len(warnings) > 0 {
+		rsp["warnings"] = warnings
+	}
+	rsp.WriteTo(w)
+}
+
+// DraftUnstage removes a single key from the draft.
+func (h *v3Handlers) DraftUnstage(w http.ResponseWriter, r *http.Request) {
+	_, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	// only the login is checked
+	release()
+
+	key := r.FormValue("key")
+	sess := h.sessmgr.SessionStart(w, r)
+	host, d := h.getDraft(sess)
+	d.Ops = slices.DeleteFunc(d.Ops, func(o draftOp) bool {
+		return o.Key == key
+	})
+
+	_ = sess.Set(draftSessionKey(host), &d)
+	Rsp{"status": "ok", "total": len(d.Ops)}.WriteTo(w)
+}
+
+func (h *v3Handlers) DraftDiscard(w http.ResponseWriter, r *http.Request) {
+	_, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	// only the login is checked
+	release()
+
+	sess := h.sessmgr.SessionStart(w, r)
+	host, _ := h.getDraft(sess)
+	_ = sess.Delete(draftSessionKey(host))
+	Rsp{"status": "ok"}.WriteTo(w)
+}
+
+// DraftCommit applies the whole draft in one transaction which fails if any
+// staged key was modified after it was staged.
+func (h *v3Handlers) DraftCommit(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method": r.Method,
+		"host":   cli.Host,
+		"uname":  cli.Username,
+	})
+
+	sess := h.sessmgr.SessionStart(w, r)
+	host, d := h.getDraft(sess)
+	if len(d.Ops) == 0 {
+		Rsp{"errorCode": 500, "message": "The draft is empty."}.WriteTo(w)
+		return
+	}
+	if len(d.Ops) > maxDraftOps {
+		Rsp{"errorCode": 400, "message": "The draft has more than " + strconv.Itoa(maxDraftOps) + " keys, which etcd can not commit in one transaction."}.WriteTo(w)
+		return
+	}
+
+	ctx := r.Context()
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	pc := newPolicyCheck(r, cli.Client, &cf)
+	var warnings []string
+	for _, o := range d.Ops {
+		var value string
+		if o.Op == opPut {
+			value = cf.decodeStored(o.Key, []byte(o.Value))
+		}
+		ws, err := pc.check(o.Op, o.Key, "", value)
+		if err != nil {
+			logger.Infof("policy check of %s: %v", o.Key, err)
+			writePolicyErr(w, err)
+			return
+		}
+		warnings = append(warnings, ws...)
+	}
+
+	cmps := make([]clientv3.Cmp, len(d.Ops))
+	ops := make([]clientv3.Op, len(d.Ops))
+	for i, o := range d.Ops {
+		cmps[i] = clientv3.Compare(clientv3.ModRevision(o.Key), "=", o.BaseRevision)
+		if o.Op == opDelete {
+			ops[i] = clientv3.OpDelete(o.Key)
+		} else {
+			ops[i] = clientv3.OpPut(o.Key, o.Value)
+		}
+	}
+
+	// deleted keys are kept in the trash like deletes from the tree
+	kvs, err := readDeleted(ctx, cli.Client, ops)
+	if err != nil {
+		Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+	e := trashEntry{User: identity(r, cli.Client)}
+	for _, kv := range kvs {
+		e.Keys = append(e.Keys, string(kv.Key))
+	}
+	if len(e.Keys) > 0 {
+		e.Key = e.Keys[0]
+	}
+	if len(e.Keys) == 1 {
+		e.Keys = nil
+	}
+	t, err := keepInTrash(ctx, cli.Client, &cf, e, kvs)
+	if err != nil {
+		logger.Warnf("keep in trash failed: %v", err)
+		Rsp{"errorCode": 500, "message": err.Error()}.WriteTo(w)
+		return
+	}
+
+	txnOps := ops
+	if t != nil {
+		txnOps = append(slices.Clip(ops), t.op())
+	}
+	txnRsp, err := cli.Txn(ctx).If(cmps...).Then(txnOps...).Commit()
+	t.finish(ctx, cli.Client, txnRsp, err)
+	if err != nil {
+		logger.Warnf("commit draft failed: %v", err)
+		Rsp{"errorCode": 500, "message": "commit draft failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	if !txnRsp.Succeeded {
+		var conflicts []string
+		for _, o := range d.Ops {
+			getRsp, err := cli.Get(ctx, o.Key, clientv3.WithKeysOnly())
+			if err != nil {
+				continue
+			}
+
+			var rev int64
+			if len(getRsp.Kvs) > 0 {
+				rev = getRsp.Kvs[0].ModRevision
+			}
+			if rev != o.BaseRevision {
+				conflicts = append(conflicts, o.Key)
+			}
+		}
+
+		logger.Warnf("commit draft conflicts: %v", conflicts)
+		Rsp{"errorCode": 409, "message": "Some keys were modified after they were staged.", "conflicts": conflicts}.WriteTo(w)
+		return
+	}
+
+	_ = sess.Delete(draftSessionKey(host))
+	logger.Infof("draft committed %d ops at revision %d", len(ops), txnRsp.Header.Revision)
+	rsp := Rsp{"status": "ok", "revision": txnRsp.Header.Revision, "total": len(ops)}
+	if len(warnings) > 0 {
+		rsp["warnings"] = warnings
+	}
+	rsp.WriteTo(w)
+}
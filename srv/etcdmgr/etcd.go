@@ -2,63 +2,127 @@ package etcdmgr
 
 import (
 	"container/list"
+	"context"
 	"sync"
 	"time"
 
+	"github.com/welllog/olog"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+// healthCheckTimeout bounds the health check of a single client.
+const healthCheckTimeout = 5 * time.Second
+
+// HealthCheck reports why a client is broken, or nil if it is healthy.
+type HealthCheck func(ctx context.Context, c *clientv3.Client) error
+
+type Option func(*EtcdManager)
+
+// WithMaxClients limits the number of clients, the least recently used are
+// removed when more are stored. 0 means no limit.
+func WithMaxClients(n int) Option {
+	return func(m *EtcdManager) {
+		m.maxClients = n
+	}
+}
+
+// WithHealthCheck checks all clients every interval and removes those check
+// reports broken.
+func WithHealthCheck(interval time.Duration, check HealthCheck) Option {
+	return func(m *EtcdManager) {
+		m.healthInterval = interval
+		m.check = check
+	}
+}
+
+// etcdItem is a client with the number of requests using it. A client that is
+// removed while in use is closed when the last of them returns it.
 type etcdItem struct {
 	key          string
 	timeAccessed int64
 	client       *clientv3.Client
+	refs         int
+	removed      bool
 }
 
 type EtcdManager struct {
-	clients    map[string]*list.Element
-	list       *list.List
-	maxIdeSecs int64
-	mu         sync.Mutex
+	clients        map[string]*list.Element
+	list           *list.List
+	maxIdeSecs     int64
+	maxClients     int
+	healthInterval time.Duration
+	check          HealthCheck
+	mu             sync.Mutex
+	closed         bool
+	done           chan struct{}
 }
 
-func NewEtcdManager(maxIdeSecs int64) *EtcdManager {
+func NewEtcdManager(maxIdeSecs int64, opts ...Option) *EtcdManager {
 	mgr := &EtcdManager{
 		clients:    make(map[string]*list.Element, 2),
 		list:       list.New(),
 		maxIdeSecs: maxIdeSecs,
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(mgr)
 	}
 
 	go mgr.gc()
+	if mgr.check != nil && mgr.healthInterval > 0 {
+		go mgr.healthCheck()
+	}
 
 	return mgr
 }
 
-func (m *EtcdManager) GetClient(key string) (*clientv3.Client, bool) {
+// Borrow returns the client of key, release must be called once it is no longer used.
+func (m *EtcdManager) Borrow(key string) (*clientv3.Client, func(), bool) {
 	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	i, ok := m.clients[key]
-	if ok {
-		i.Value.(*etcdItem).timeAccessed = time.Now().Unix()
-		m.list.MoveToBack(i)
+	ele, ok := m.clients[key]
+	if !ok {
+		return nil, nil, false
 	}
 
-	m.mu.Unlock()
+	return ele.Value.(*etcdItem).client, m.borrow(ele), true
+}
 
-	if !ok {
-		return nil, false
+// BorrowOrStore borrows the client of key, or stores c as the client of key and
+// borrows it if there is none. stored reports whether c was stored, if not the
+// caller still owns c.
+func (m *EtcdManager) BorrowOrStore(key string, c *clientv3.Client) (cli *clientv3.Client, release func(), stored bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ele, ok := m.clients[key]; ok {
+		return ele.Value.(*etcdItem).client, m.borrow(ele), false
+	}
+
+	if m.closed {
+		// nothing is stored after Close, the client is used only by the caller
+		return c, func() { c.Close() }, true
 	}
 
-	return i.Value.(*etcdItem).client, true
+	ele := m.list.PushBack(&etcdItem{
+		key:          key,
+		timeAccessed: time.Now().Unix(),
+		client:       c,
+	})
+	m.clients[key] = ele
+	m.evict()
+	return c, m.borrow(ele), true
 }
 
+// SetClient stores c as the client of key, the client it replaces is closed once
+// it is no longer used.
 func (m *EtcdManager) SetClient(key string, c *clientv3.Client) {
 	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	oi, ok := m.clients[key]
-	if ok {
-		m.list.Remove(oi)
-		// ? the client maybe used by other goroutine
-		oi.Value.(*etcdItem).client.Close()
+	if oi, ok := m.clients[key]; ok {
+		m.remove(oi)
 	}
 
 	ele := m.list.PushBack(&etcdItem{
@@ -67,51 +131,144 @@ func (m *EtcdManager) SetClient(key string, c *clientv3.Client) {
 		client:       c,
 	})
 	m.clients[key] = ele
+	m.evict()
+}
 
-	m.mu.Unlock()
+// RemoveClient removes the client of key, it is closed once it is no longer used.
+func (m *EtcdManager) RemoveClient(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ele, ok := m.clients[key]; ok {
+		m.remove(ele)
+	}
 }
 
-func (m *EtcdManager) SetClientNX(key string, c *clientv3.Client) bool {
+// RemoveClients removes the clients whose key match reports, they are closed once
+// they are no longer used. It returns the number of clients removed.
+func (m *EtcdManager) RemoveClients(match func(key string) bool) int {
 	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	_, ok := m.clients[key]
-	if !ok {
-		ele := m.list.PushBack(&etcdItem{
-			key:          key,
-			timeAccessed: time.Now().Unix(),
-			client:       c,
+	var n int
+	for ele := m.list.Front(); ele != nil; {
+		next := ele.Next()
+		if match(ele.Value.(*etcdItem).key) {
+			m.remove(ele)
+			n++
+		}
+		ele = next
+	}
+	return n
+}
+
+// Close closes all clients, clients borrowed after are not stored.
+func (m *EtcdManager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.done)
+
+	for ele := m.list.Front(); ele != nil; ele = m.list.Front() {
+		i := ele.Value.(*etcdItem)
+		m.list.Remove(ele)
+		delete(m.clients, i.key)
+		i.removed = true
+		i.client.Close()
+	}
+}
+
+func (m *EtcdManager) borrow(ele *list.Element) func() {
+	i := ele.Value.(*etcdItem)
+	i.refs++
+	i.timeAccessed = time.Now().Unix()
+	m.list.MoveToBack(ele)
+
+	release := m.unborrow(i)
+	return func() {
+		release()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		// the end of a long request counts as access too
+		if !i.removed {
+			i.timeAccessed = time.Now().Unix()
+			m.list.MoveToBack(ele)
+		}
+	}
+}
+
+// unborrow returns the func giving back a reference to i, it closes the client
+// of a removed item with the last reference.
+func (m *EtcdManager) unborrow(i *etcdItem) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+
+			i.refs--
+			if i.removed && i.refs == 0 && !m.closed {
+				i.client.Close()
+			}
 		})
-		m.clients[key] = ele
 	}
+}
 
-	m.mu.Unlock()
+// evict removes the least recently used clients over the limit, those in use are
+// closed once they are returned. m.mu must be held.
+func (m *EtcdManager) evict() {
+	for m.maxClients > 0 && m.list.Len() > m.maxClients {
+		ele := m.list.Front()
+		olog.Infof("too many etcd clients, remove the least recently used %s", ele.Value.(*etcdItem).key)
+		m.remove(ele)
+	}
+}
 
-	return !ok
+// remove takes an item out of the manager and closes its client unless it is
+// in use. m.mu must be held.
+func (m *EtcdManager) remove(ele *list.Element) {
+	i := ele.Value.(*etcdItem)
+	m.list.Remove(ele)
+	delete(m.clients, i.key)
+	i.removed = true
+	if i.refs == 0 {
+		i.client.Close()
+	}
 }
 
 func (m *EtcdManager) gc() {
 	timer := time.NewTimer(time.Duration(m.maxIdeSecs) * time.Second)
+	defer timer.Stop()
 
 	for {
-		now := <-timer.C
+		var now time.Time
+		select {
+		case now = <-timer.C:
+		case <-m.done:
+			return
+		}
 		unix := now.Unix()
 
 		m.mu.Lock()
 
-		for {
-			ele := m.list.Front()
-			if ele == nil {
-				break
-			}
-
+		for ele := m.list.Front(); ele != nil; {
 			i := ele.Value.(*etcdItem)
 			if unix-i.timeAccessed < m.maxIdeSecs {
 				break
 			}
 
-			m.list.Remove(ele)
-			i.client.Close()
-			delete(m.clients, i.key)
+			next := ele.Next()
+			// clients in use are not idle, however long ago they were borrowed
+			if i.refs == 0 {
+				m.remove(ele)
+			}
+			ele = next
 		}
 
 		m.mu.Unlock()
@@ -119,3 +276,59 @@ func (m *EtcdManager) gc() {
 		timer.Reset(time.Duration(m.maxIdeSecs) * time.Second)
 	}
 }
+
+// healthCheck removes the clients that fail the check every healthInterval.
+func (m *EtcdManager) healthCheck() {
+	ticker := time.NewTicker(m.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+
+		// clients are borrowed while they are checked, so removing them does not
+		// close them under the check
+		type checked struct {
+			ele     *list.Element
+			release func()
+			err     error
+		}
+		m.mu.Lock()
+		items := make([]*checked, 0, m.list.Len())
+		for ele := m.list.Front(); ele != nil; ele = ele.Next() {
+			i := ele.Value.(*etcdItem)
+			i.refs++
+			items = append(items, &checked{ele: ele, release: m.unborrow(i)})
+		}
+		m.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, c := range items {
+			wg.Add(1)
+			go func(c *checked) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+				defer cancel()
+				c.err = m.check(ctx, c.ele.Value.(*etcdItem).client)
+			}(c)
+		}
+		wg.Wait()
+
+		m.mu.Lock()
+		for _, c := range items {
+			i := c.ele.Value.(*etcdItem)
+			if c.err != nil && !i.removed {
+				olog.Warnf("etcd client %s is broken, remove it: %v", i.key, c.err)
+				m.remove(c.ele)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, c := range items {
+			c.release()
+		}
+	}
+}
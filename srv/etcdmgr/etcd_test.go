@@ -0,0 +1,293 @@
+package etcdmgr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// newTestClient returns a client that never dials, DialTimeout 0 does not wait
+// for the connection.
+func newTestClient(t *testing.T) *clientv3.Client {
+	t.Helper()
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{"127.0.0.1:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func isClosed(c *clientv3.Client) bool {
+	return c.Ctx().Err() != nil
+}
+
+func newTestManager(t *testing.T, opts ...Option) *EtcdManager {
+	t.Helper()
+	m := NewEtcdManager(3600, opts...)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestBorrow(t *testing.T) {
+	m := newTestManager(t)
+	c := newTestClient(t)
+
+	if _, _, ok := m.Borrow("a"); ok {
+		t.Fatal("borrowed a client that was never stored")
+	}
+
+	m.SetClient("a", c)
+	got, release, ok := m.Borrow("a")
+	if !ok || got != c {
+		t.Fatalf("Borrow = %p, %v, want %p", got, ok, c)
+	}
+	release()
+
+	if isClosed(c) {
+		t.Error("released client is closed while stored")
+	}
+}
+
+func TestBorrowOrStore(t *testing.T) {
+	m := newTestManager(t)
+	c1, c2 := newTestClient(t), newTestClient(t)
+
+	got, release, stored := m.BorrowOrStore("a", c1)
+	if !stored || got != c1 {
+		t.Fatalf("first BorrowOrStore = %p, %v, want %p stored", got, stored, c1)
+	}
+	release()
+
+	got, release, stored = m.BorrowOrStore("a", c2)
+	if stored || got != c1 {
+		t.Fatalf("second BorrowOrStore = %p, %v, want the stored %p", got, stored, c1)
+	}
+	release()
+
+	if isClosed(c2) {
+		t.Error("the client not stored is closed, the caller owns it")
+	}
+}
+
+func TestRemoveWhileBorrowed(t *testing.T) {
+	m := newTestManager(t)
+	c := newTestClient(t)
+	m.SetClient("a", c)
+
+	_, release, _ := m.Borrow("a")
+	m.RemoveClient("a")
+
+	if isClosed(c) {
+		t.Fatal("client closed while borrowed")
+	}
+	if _, _, ok := m.Borrow("a"); ok {
+		t.Fatal("removed client can still be borrowed")
+	}
+
+	release()
+	if !isClosed(c) {
+		t.Error("removed client not closed by the last release")
+	}
+}
+
+func TestSetClientReplacesBorrowed(t *testing.T) {
+	m := newTestManager(t)
+	c1, c2 := newTestClient(t), newTestClient(t)
+	m.SetClient("a", c1)
+
+	_, release, _ := m.Borrow("a")
+	m.SetClient("a", c2)
+
+	if isClosed(c1) {
+		t.Fatal("replaced client closed while borrowed")
+	}
+	if got, r, ok := m.Borrow("a"); !ok || got != c2 {
+		t.Fatalf("Borrow after SetClient = %p, %v, want %p", got, ok, c2)
+	} else {
+		r()
+	}
+
+	release()
+	if !isClosed(c1) {
+		t.Error("replaced client not closed by the last release")
+	}
+	if isClosed(c2) {
+		t.Error("new client closed")
+	}
+}
+
+func TestReleaseTwice(t *testing.T) {
+	m := newTestManager(t)
+	c := newTestClient(t)
+	m.SetClient("a", c)
+
+	_, release1, _ := m.Borrow("a")
+	_, release2, _ := m.Borrow("a")
+	m.RemoveClient("a")
+
+	// a second call of the same release must not give back the other borrow
+	release1()
+	release1()
+	if isClosed(c) {
+		t.Fatal("client closed while still borrowed")
+	}
+
+	release2()
+	if !isClosed(c) {
+		t.Error("client not closed by the last release")
+	}
+}
+
+func TestCloseWithBorrows(t *testing.T) {
+	m := NewEtcdManager(3600)
+	c := newTestClient(t)
+	m.SetClient("a", c)
+
+	_, release, _ := m.Borrow("a")
+	m.Close()
+	if !isClosed(c) {
+		t.Fatal("Close did not close a borrowed client")
+	}
+
+	// releasing after Close and closing twice are harmless
+	release()
+	m.Close()
+
+	c2 := newTestClient(t)
+	got, release, stored := m.BorrowOrStore("b", c2)
+	if !stored || got != c2 {
+		t.Fatalf("BorrowOrStore after Close = %p, %v, want %p", got, stored, c2)
+	}
+	if _, _, ok := m.Borrow("b"); ok {
+		t.Fatal("client stored after Close")
+	}
+	release()
+	if !isClosed(c2) {
+		t.Error("client borrowed after Close not closed by its release")
+	}
+}
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+	m := newTestManager(t, WithMaxClients(2))
+	a, b, c := newTestClient(t), newTestClient(t), newTestClient(t)
+	m.SetClient("a", a)
+	m.SetClient("b", b)
+
+	// borrowing a makes b the least recently used
+	_, release, _ := m.Borrow("a")
+	release()
+	m.SetClient("c", c)
+
+	if _, _, ok := m.Borrow("b"); ok {
+		t.Error("least recently used client not evicted")
+	}
+	if !isClosed(b) {
+		t.Error("evicted client not closed")
+	}
+	for key, cli := range map[string]*clientv3.Client{"a": a, "c": c} {
+		if _, r, ok := m.Borrow(key); !ok {
+			t.Errorf("client %s evicted", key)
+		} else {
+			r()
+		}
+		if isClosed(cli) {
+			t.Errorf("client %s closed", key)
+		}
+	}
+}
+
+func TestEvictInUse(t *testing.T) {
+	m := newTestManager(t, WithMaxClients(1))
+	a, b := newTestClient(t), newTestClient(t)
+	m.SetClient("a", a)
+
+	_, release, _ := m.Borrow("a")
+	m.SetClient("b", b)
+
+	if _, _, ok := m.Borrow("a"); ok {
+		t.Fatal("client over the limit not evicted")
+	}
+	if isClosed(a) {
+		t.Fatal("evicted client closed while borrowed")
+	}
+
+	release()
+	if !isClosed(a) {
+		t.Error("evicted client not closed by the last release")
+	}
+}
+
+func TestHealthCheckRemovesBroken(t *testing.T) {
+	good, bad := newTestClient(t), newTestClient(t)
+	checked := make(chan struct{}, 16)
+	check := func(ctx context.Context, c *clientv3.Client) error {
+		defer func() { checked <- struct{}{} }()
+		if c == bad {
+			return errors.New("broken")
+		}
+		return nil
+	}
+
+	m := newTestManager(t, WithHealthCheck(10*time.Millisecond, check))
+	m.SetClient("good", good)
+	m.SetClient("bad", bad)
+
+	// after two rounds the first one has finished
+	for i := 0; i < 4; i++ {
+		<-checked
+	}
+
+	m.mu.Lock()
+	_, badStored := m.clients["bad"]
+	_, goodStored := m.clients["good"]
+	m.mu.Unlock()
+
+	if badStored || !isClosed(bad) {
+		t.Errorf("broken client stored %v, closed %v, want removed and closed", badStored, isClosed(bad))
+	}
+	if !goodStored || isClosed(good) {
+		t.Errorf("healthy client stored %v, closed %v, want kept open", goodStored, isClosed(good))
+	}
+}
+
+func TestHealthCheckBorrowsChecked(t *testing.T) {
+	c := newTestClient(t)
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	var closedDuringCheck atomic.Bool
+	var once sync.Once
+	check := func(ctx context.Context, cli *clientv3.Client) error {
+		once.Do(func() {
+			close(started)
+			<-proceed
+			closedDuringCheck.Store(isClosed(cli))
+		})
+		return nil
+	}
+
+	m := newTestManager(t, WithHealthCheck(10*time.Millisecond, check))
+	m.SetClient("a", c)
+
+	<-started
+	// the client is removed while it is checked
+	m.RemoveClient("a")
+	close(proceed)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !isClosed(c) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if closedDuringCheck.Load() {
+		t.Error("client closed while it was checked")
+	}
+	if !isClosed(c) {
+		t.Error("removed client not closed after the check")
+	}
+}
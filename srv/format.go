@@ -0,0 +1,397 @@
+package srv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/welllog/olog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	formatJSON       = "json"
+	formatYAML       = "yaml"
+	formatTOML       = "toml"
+	formatINI        = "ini"
+	formatProperties = "properties"
+	// formatNone disables validation for keys whose format would be detected.
+	formatNone = "none"
+)
+
+type FormatConf struct {
+	Prefix string `yaml:"prefix"`
+	// Format is one of json, yaml, toml, ini, properties or none.
+	Format string `yaml:"format"`
+	// Normalize rewrites valid values in the canonical layout of their format.
+	Normalize bool `yaml:"normalize"`
+}
+
+// formatExts detects the format of keys without configured format.
+var formatExts = map[string]string{
+	".json":       formatJSON,
+	".yaml":       formatYAML,
+	".yml":        formatYAML,
+	".toml":       formatTOML,
+	".ini":        formatINI,
+	".properties": formatProperties,
+}
+
+// syntaxError reports where a value fails to parse. Line and Column start at 1,
+// 0 means unknown.
+type syntaxError struct {
+	Format  string `json:"format"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *syntaxError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("The value is not valid ")
+	sb.WriteString(e.Format)
+	if e.Line > 0 {
+		sb.WriteString(" at line ")
+		sb.WriteString(strconv.Itoa(e.Line))
+		if e.Column > 0 {
+			sb.WriteString(", column ")
+			sb.WriteString(strconv.Itoa(e.Column))
+		}
+	}
+	sb.WriteString(": ")
+	sb.WriteString(e.Message)
+	return sb.String()
+}
+
+// FormatFor returns the format of key and whether its values are normalized by
+// default. The longest configured prefix wins, otherwise the format is detected
+// from the extension of key.
+func (e *Etcd) FormatFor(key string) (string, bool) {
+	if fc := e.formatConf(key); fc != nil {
+		return fc.Format, fc.Normalize
+	}
+	return formatExts[strings.ToLower(path.Ext(key))], false
+}
+
+// formatConf returns the format configured for the longest prefix of key, nil if none is.
+func (e *Etcd) formatConf(key string) *FormatConf {
+	var found *FormatConf
+	for i := range e.Formats {
+		fc := &e.Formats[i]
+		if strings.HasPrefix(key, fc.Prefix) && (found == nil || len(fc.Prefix) > len(found.Prefix)) {
+			found = fc
+		}
+	}
+	return found
+}
+
+// formatValue checks the syntax of value and returns it canonically formatted if
+// requested. An empty format or normalize falls back to the configuration of key.
+// Empty values are not checked. Syntax errors of formats detected from the extension
+// of key only are returned as warnings, the key may be named so by chance.
+func (e *Etcd) formatValue(key, value, format, normalize string) (string, []string, error) {
+	if strings.TrimSpace(value) == "" {
+		return value, nil, nil
+	}
+
+	defFormat, defNormalize := e.FormatFor(key)
+	detected := false
+	if format == "" {
+		format = defFormat
+		detected = e.formatConf(key) == nil
+	}
+	norm := defNormalize
+	if normalize != "" {
+		norm = normalize == "true"
+	}
+
+	var f func(string) (string, error)
+	switch format {
+	case "", formatNone:
+		return value, nil, nil
+	case formatJSON:
+		f = formatJSONValue
+	case formatYAML:
+		f = formatYAMLValue
+	case formatTOML:
+		f = formatTOMLValue
+	case formatINI:
+		f = formatINIValue
+	case formatProperties:
+		f = formatPropertiesValue
+	default:
+		return "", nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	formatted, err := f(value)
+	if err != nil && detected {
+		return value, []string{err.Error()}, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if norm {
+		return formatted, nil, nil
+	}
+	return value, nil, nil
+}
+
+// checkValue checks the format and the schema of a value written to key and returns
+// the value to store. Raw values are stored as is, they are checked decoded with the
+// codec of key and are not normalized then. Raw values the codec can not decode are
+// not checked, the editor shows and saves them as stored.
+func (e *Etcd) checkValue(key, value, format, normalize string, raw bool) (string, []string, error) {
+	checked := value
+	if raw {
+		if name, c, ok := e.CodecFor(key); ok {
+			b, err := c.Decode([]byte(value))
+			if err != nil {
+				olog.Debugf("decode %s with %s failed, the value is not checked: %v", key, name, err)
+				return value, nil, nil
+			}
+			checked = string(b)
+			normalize = "false"
+		}
+	}
+
+	formatted, warnings, err := e.formatValue(key, checked, format, normalize)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := e.validateSchema(key, formatted); err != nil {
+		return "", nil, err
+	}
+	if raw {
+		return value, warnings, nil
+	}
+	return formatted, warnings, nil
+}
+
+func formatJSONValue(value string) (string, error) {
+	trimmed := strings.TrimLeft(value, " \t\r\n")
+	var buf bytes.Buffer
+	err := json.Indent(&buf, []byte(strings.TrimRight(trimmed, " \t\r\n")), "", "  ")
+	if err == nil {
+		return buf.String(), nil
+	}
+
+	se := &syntaxError{Format: formatJSON, Message: err.Error()}
+	var jerr *json.SyntaxError
+	if errors.As(err, &jerr) {
+		se.Line, se.Column = lineColumn(value, len(value)-len(trimmed)+int(jerr.Offset))
+		se.Message = strings.TrimPrefix(se.Message, "json: ")
+	}
+	return "", se
+}
+
+var yamlLineRe = regexp.MustCompile(`^yaml: line (\d+): `)
+
+func formatYAMLValue(value string) (string, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+
+	dec := yaml.NewDecoder(strings.NewReader(value))
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			se := &syntaxError{Format: formatYAML, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+			if m := yamlLineRe.FindStringSubmatch(err.Error()); m != nil {
+				se.Line, _ = strconv.Atoi(m[1])
+				se.Message = err.Error()[len(m[0]):]
+			}
+			return "", se
+		}
+		if err := enc.Encode(&doc); err != nil {
+			return "", &syntaxError{Format: formatYAML, Message: err.Error()}
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// formatTOMLValue normalizes by decoding and encoding the document, comments
+// are not kept.
+func formatTOMLValue(value string) (string, error) {
+	var v map[string]any
+	if _, err := toml.Decode(value, &v); err != nil {
+		se := &syntaxError{Format: formatTOML, Message: err.Error()}
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			se.Line, se.Column = perr.Position.Line, perr.Position.Col
+			se.Message = perr.Message
+		}
+		return "", se
+	}
+
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf)
+	enc.Indent = ""
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// formatINIValue accepts sections, key = value or key: value pairs and comments
+// starting with ; or #. Normalized values use key = value and separate sections
+// with an empty line.
+func formatINIValue(value string) (string, error) {
+	var buf bytes.Buffer
+	sc := bufio.NewScanner(strings.NewReader(value))
+	sc.Buffer(nil, len(value)+1)
+	for n := 1; sc.Scan(); n++ {
+		raw := sc.Text()
+		line := strings.TrimSpace(raw)
+		switch {
+		case line == "":
+			continue
+		case line[0] == ';' || line[0] == '#':
+			buf.WriteString(line)
+		case line[0] == '[':
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return "", &syntaxError{Format: formatINI, Line: n, Column: len(raw) + 1, Message: "missing ] of section header"}
+			}
+			name := strings.TrimSpace(line[1:end])
+			if name == "" {
+				return "", &syntaxError{Format: formatINI, Line: n, Column: indexColumn(raw, "]"), Message: "empty section name"}
+			}
+			if rest := strings.TrimSpace(line[end+1:]); rest != "" && rest[0] != ';' && rest[0] != '#' {
+				return "", &syntaxError{Format: formatINI, Line: n, Column: indexColumn(raw, rest), Message: "unexpected text after section header"}
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString("[" + name + "]")
+		default:
+			i := strings.IndexAny(line, "=:")
+			if i < 0 {
+				return "", &syntaxError{Format: formatINI, Line: n, Column: indexColumn(raw, line), Message: "expected key = value"}
+			}
+			k := strings.TrimSpace(line[:i])
+			if k == "" {
+				return "", &syntaxError{Format: formatINI, Line: n, Column: indexColumn(raw, line), Message: "empty key"}
+			}
+			buf.WriteString(k + " = " + strings.TrimSpace(line[i+1:]))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String(), sc.Err()
+}
+
+// formatPropertiesValue parses Java properties. Almost any text is a valid
+// properties file, only broken unicode escapes are rejected. Normalized values
+// join continuation lines and use key=value.
+func formatPropertiesValue(value string) (string, error) {
+	var buf bytes.Buffer
+	lines := strings.Split(value, "\n")
+	for n := 0; n < len(lines); n++ {
+		start := n + 1
+		line := strings.TrimLeft(strings.TrimSuffix(lines[n], "\r"), " \t\f")
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' || line[0] == '!' {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+			continue
+		}
+
+		// A line ending with an odd number of backslashes continues on the next line.
+		for endsWithEscape(line) && n+1 < len(lines) {
+			n++
+			line = line[:len(line)-1] + strings.TrimLeft(strings.TrimSuffix(lines[n], "\r"), " \t\f")
+		}
+
+		if col, msg := checkEscapes(line); msg != "" {
+			return "", &syntaxError{Format: formatProperties, Line: start, Column: col, Message: msg}
+		}
+
+		k, v := splitProperty(line)
+		buf.WriteString(k + "=" + v)
+		buf.WriteByte('\n')
+	}
+	return buf.String(), nil
+}
+
+func endsWithEscape(line string) bool {
+	n := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// checkEscapes returns the column and reason of the first invalid \uXXXX escape.
+func checkEscapes(line string) (int, string) {
+	for i := 0; i < len(line); i++ {
+		if line[i] != '\\' {
+			continue
+		}
+		if i+1 < len(line) && line[i+1] == 'u' {
+			if i+6 > len(line) {
+				return i + 1, "incomplete unicode escape"
+			}
+			if _, err := strconv.ParseUint(line[i+2:i+6], 16, 16); err != nil {
+				return i + 1, "invalid unicode escape " + line[i:i+6]
+			}
+		}
+		i++
+	}
+	return 0, ""
+}
+
+// splitProperty splits a logical line at the first unescaped =, : or whitespace,
+// the key and the value keep their escapes.
+func splitProperty(line string) (string, string) {
+	i := 0
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' {
+			i++
+			continue
+		}
+		if c == '=' || c == ':' || c == ' ' || c == '\t' || c == '\f' {
+			break
+		}
+	}
+	if i >= len(line) {
+		return line, ""
+	}
+
+	k, rest := line[:i], strings.TrimLeft(line[i:], " \t\f")
+	if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+	return k, rest
+}
+
+// lineColumn converts a byte offset of s into a line and column.
+func lineColumn(s string, offset int) (int, int) {
+	if offset > len(s) {
+		offset = len(s)
+	}
+	before := s[:offset]
+	line := strings.Count(before, "\n") + 1
+	return line, offset - strings.LastIndexByte(before, '\n')
+}
+
+func indexColumn(line, sub string) int {
+	return strings.Index(line, sub) + 1
+}
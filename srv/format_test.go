@@ -0,0 +1,193 @@
+package srv
+
+import (
+	"errors"
+	"testing"
+)
+
+// checkSyntax compares err with the syntax error expected at line and column,
+// line 0 expects no error.
+func checkSyntax(t *testing.T, err error, line, column int) {
+	t.Helper()
+	if line == 0 {
+		if err != nil {
+			t.Fatalf("err = %v, want nil", err)
+		}
+		return
+	}
+
+	var se *syntaxError
+	if !errors.As(err, &se) {
+		t.Fatalf("err = %v, want a syntax error", err)
+	}
+	if se.Line != line || se.Column != column {
+		t.Errorf("position = %d:%d, want %d:%d (%v)", se.Line, se.Column, line, column, err)
+	}
+}
+
+func TestFormatINIValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   string
+		line   int
+		column int
+	}{
+		{
+			name:  "normalized",
+			value: "; top\nname=web\n\n[server]  \n  port :8080\n# end\n[db]\nhost = a=b\n",
+			want:  "; top\nname = web\n\n[server]\nport = 8080\n# end\n\n[db]\nhost = a=b\n",
+		},
+		{name: "comment after section", value: "[a] ; comment\nk=v", want: "[a]\nk = v\n"},
+		{name: "crlf", value: "[a]\r\nk=v\r\n", want: "[a]\nk = v\n"},
+		{name: "missing bracket", value: "k=v\n  [a", line: 2, column: 5},
+		{name: "empty section", value: "[ ]", line: 1, column: 3},
+		{name: "text after section", value: "[a] b", line: 1, column: 5},
+		{name: "no separator", value: "[a]\n  key", line: 2, column: 3},
+		{name: "empty key", value: "\t= v", line: 1, column: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatINIValue(tt.value)
+			checkSyntax(t, err, tt.line, tt.column)
+			if err == nil && got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatPropertiesValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   string
+		line   int
+		column int
+	}{
+		{
+			name:  "separators",
+			value: "a=1\nb : 2\nc 3\nd\n# comment\n! comment\n",
+			want:  "a=1\nb=2\nc=3\nd=\n# comment\n! comment\n",
+		},
+		{name: "escaped separators", value: `a\=b\:c=d\ e`, want: "a\\=b\\:c=d\\ e\n"},
+		{name: "continuation", value: "list = a,\\\n    b,\\\n    c\nnext=1", want: "list=a,b,c\nnext=1\n"},
+		{name: "escaped backslash ends the line", value: "path=c:\\\\\nnext=1", want: "path=c:\\\\\nnext=1\n"},
+		{name: "unicode escape", value: `name=caf\u00e9`, want: "name=caf\\u00e9\n"},
+		{name: "invalid unicode escape", value: "a=1\nname=caf\\u00zz", line: 2, column: 9},
+		{name: "incomplete unicode escape", value: "name=\\u00", line: 1, column: 6},
+		{name: "error on a continued line", value: "a=x,\\\n  \\u12", line: 1, column: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatPropertiesValue(tt.value)
+			checkSyntax(t, err, tt.line, tt.column)
+			if err == nil && got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineColumn(t *testing.T) {
+	s := "ab\ncd\n\nef"
+	tests := []struct {
+		offset       int
+		line, column int
+	}{
+		{offset: 0, line: 1, column: 1},
+		{offset: 2, line: 1, column: 3},
+		{offset: 3, line: 2, column: 1},
+		{offset: 4, line: 2, column: 2},
+		{offset: 6, line: 3, column: 1},
+		{offset: 7, line: 4, column: 1},
+		{offset: 100, line: 4, column: 3},
+	}
+
+	for _, tt := range tests {
+		line, column := lineColumn(s, tt.offset)
+		if line != tt.line || column != tt.column {
+			t.Errorf("lineColumn(%d) = %d:%d, want %d:%d", tt.offset, line, column, tt.line, tt.column)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	cf := Etcd{Formats: []FormatConf{
+		{Prefix: "/conf/", Format: formatJSON, Normalize: true},
+		{Prefix: "/conf/raw/", Format: formatNone},
+	}}
+
+	tests := []struct {
+		name     string
+		key      string
+		value    string
+		format   string
+		want     string
+		warnings int
+		invalid  bool
+	}{
+		{name: "configured and normalized", key: "/conf/a", value: `{"a":1}`, want: "{\n  \"a\": 1\n}"},
+		{name: "configured rejects", key: "/conf/a", value: `{"a":`, invalid: true},
+		{name: "configured none", key: "/conf/raw/a.json", value: `{"a":`, want: `{"a":`},
+		{name: "empty value", key: "/conf/a", value: " \n", want: " \n"},
+		{name: "detected keeps valid values", key: "/app/a.json", value: `{"a":1}`, want: `{"a":1}`},
+		{name: "detected warns", key: "/app/a.json", value: `{"a":`, want: `{"a":`, warnings: 1},
+		{name: "requested rejects", key: "/app/a.txt", value: "a = [", format: formatTOML, invalid: true},
+		{name: "requested over detected rejects", key: "/app/a.json", value: "[a", format: formatINI, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, warnings, err := cf.formatValue(tt.key, tt.value, tt.format, "")
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || len(warnings) != tt.warnings {
+				t.Errorf("got %q with warnings %q, want %q with %d", got, warnings, tt.want, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestCheckValueRaw(t *testing.T) {
+	cf := Etcd{
+		Formats: []FormatConf{{Prefix: "/z/", Format: formatJSON, Normalize: true}},
+		Codecs:  []CodecConf{{Prefix: "/z/", Codec: "snappy"}},
+	}
+	if err := cf.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := cf.encodeStored("/z/a", `{"a":1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid, err := cf.encodeStored("/z/a", `{"a":`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// raw values are checked decoded and stored as sent
+	if got, _, err := cf.checkValue("/z/a", stored, "", "", true); err != nil || got != stored {
+		t.Errorf("raw valid value = %q, %v, want the stored value", got, err)
+	}
+	if _, _, err := cf.checkValue("/z/a", invalid, "", "", true); err == nil {
+		t.Error("raw invalid value passed")
+	}
+	// the codec can not decode these, they are kept as stored
+	if got, _, err := cf.checkValue("/z/a", "\xff\xff", "", "", true); err != nil || got != "\xff\xff" {
+		t.Errorf("raw undecodable value = %q, %v", got, err)
+	}
+	if got, _, err := cf.checkValue("/z/a", `{"a":1}`, "", "", false); err != nil || got != "{\n  \"a\": 1\n}" {
+		t.Errorf("value = %q, %v, want it normalized", got, err)
+	}
+}
@@ -1,14 +1,15 @@
 package srv
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/welllog/etcdkeeper-v3/srv/etcdmgr"
@@ -19,35 +20,66 @@ import (
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+const (
+	treeDefaultLimit = 500
+	treeMaxLimit     = 5000
+	// statusTimeout bounds the status request to a single member.
+	statusTimeout = 2 * time.Second
+)
+
 type v3Handlers struct {
-	conf    Conf
-	sessmgr *session.Manager
-	climgr  *etcdmgr.EtcdManager
+	// conf is replaced as a whole when the config file is reloaded.
+	conf      atomic.Pointer[Conf]
+	sessmgr   *session.Manager
+	creds     *credentialCipher
+	logins    *loginRegistry
+	climgr    *etcdmgr.EtcdManager
+	proposals *proposalStore
 }
 
 func newV3Handlers(conf Conf) (*v3Handlers, error) {
-	sessmgr, err := session.NewManager("memory", "_etcdkeeper_session", 3600)
+	sessmgr, err := session.NewManager(conf.Session.Provider, "_etcdkeeper_session", 3600, conf.Session.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	sessmgr.SetCookieAttributes(conf.Session.Secure, conf.Session.sameSite())
+
+	creds, err := newCredentialCipher(conf.Session.Key)
 	if err != nil {
 		return nil, err
 	}
 
+	logins := newLoginRegistry(3600)
+	sessmgr.OnGC(logins.gc)
 	time.AfterFunc(86400*time.Second, func() {
 		sessmgr.GC()
 	})
 
-	return &v3Handlers{
-		conf:    conf,
-		sessmgr: sessmgr,
-		climgr:  etcdmgr.NewEtcdManager(3780),
-	}, nil
+	climgr := etcdmgr.NewEtcdManager(3780,
+		etcdmgr.WithMaxClients(conf.MaxClients),
+		etcdmgr.WithHealthCheck(time.Duration(conf.HealthCheckInterval)*time.Second, checkEtcdClient),
+	)
+
+	h := &v3Handlers{
+		sessmgr:   sessmgr,
+		creds:     creds,
+		logins:    logins,
+		climgr:    climgr,
+		proposals: newProposalStore(),
+	}
+	h.conf.Store(&conf)
+	return h, nil
 }
 
 func (h *v3Handlers) Hosts(w http.ResponseWriter, r *http.Request) {
-	hosts := make([]HostInfo, len(h.conf.Etcds))
-	for i := range h.conf.Etcds {
+	conf := h.conf.Load()
+	hosts := make([]HostInfo, len(conf.Etcds))
+	for i := range conf.Etcds {
 		hosts[i] = HostInfo{
-			Host: h.conf.Etcds[i].Endpoints,
-			Name: h.conf.Etcds[i].Name,
+			Host:      conf.Etcds[i].Name,
+			Name:      conf.Etcds[i].Name,
+			Endpoints: conf.Etcds[i].Endpoints.String(),
 		}
 	}
 
@@ -57,10 +89,11 @@ func (h *v3Handlers) Hosts(w http.ResponseWriter, r *http.Request) {
 func (h *v3Handlers) Connect(w http.ResponseWriter, r *http.Request) {
 	sess := h.sessmgr.SessionStart(w, r)
 	cuinfo := userInfo{
-		Host:   r.FormValue("host"),
-		Name:   r.FormValue("uname"),
-		Passwd: r.FormValue("passwd"),
+		Host: h.conf.Load().ClusterName(r.FormValue("host")),
+		Name: r.FormValue("uname"),
 	}
+	_, cuinfo.Cluster = h.conf.Load().GetEtcdConfig(cuinfo.Host)
+	passwd := r.FormValue("passwd")
 
 	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
 		"method": r.Method,
@@ -80,14 +113,20 @@ func (h *v3Handlers) Connect(w http.ResponseWriter, r *http.Request) {
 			goto login
 		}
 
-		cliKey := genCliKey(cuinfo.Host, uinfo.Name)
-		cli, ok := h.climgr.GetClient(cliKey)
-		if !ok {
-			// current host client not exists
+		cli, release, err := h.sessionCli(uinfo)
+		if err != nil {
+			// current host client can not be recreated from the session
+			logger.Warnf("reconnect from session failed: %v", err)
+			if uinfo.Cluster && !cuinfo.Cluster {
+				// the cluster was removed, its name is no endpoint to log in to
+				Rsp{"status": "error", "message": err.Error()}.WriteTo(w)
+				return
+			}
 			goto login
 		}
+		defer release()
 
-		info, err := h.getEtcdInfo(ctx, cli, cuinfo.Host)
+		info, err := h.getEtcdInfo(ctx, cli)
 		if err != nil {
 			logger.Warnf("login user get etcd info err: %v", err)
 			Rsp{"status": "error", "message": err.Error()}.WriteTo(w)
@@ -95,6 +134,7 @@ func (h *v3Handlers) Connect(w http.ResponseWriter, r *http.Request) {
 		}
 
 		_ = sess.Set("host", cuinfo.Host)
+		h.logins.seen(r, sess.SessionID(), cuinfo.Host, uinfo.Name)
 		Rsp{"status": "running", "info": info}.WriteTo(w)
 		return
 	}
@@ -102,15 +142,15 @@ func (h *v3Handlers) Connect(w http.ResponseWriter, r *http.Request) {
 login:
 	cliKey := genCliKey(cuinfo.Host, cuinfo.Name)
 	var closeNewCli bool
-	cli, reuse := h.climgr.GetClient(cliKey)
+	cli, release, reuse := h.climgr.Borrow(cliKey)
 	if !reuse {
-		cf, ok := h.conf.GetEtcdConfig(cuinfo.Host)
+		cf, ok := h.conf.Load().GetEtcdConfig(cuinfo.Host)
 		if !ok {
-			cf.Endpoints = cuinfo.Host
+			cf.Endpoints = splitEndpoints(cuinfo.Host)
 		}
 
 		var err error
-		cli, err = newEtcdClient(cuinfo.Name, cuinfo.Passwd, cf)
+		cli, err = newEtcdClient(cuinfo.Name, passwd, cf)
 		if err != nil {
 			logger.Warnf("%s connect %s failed: %v", cuinfo.Name, cf.Endpoints, err)
 			if isEtcdServerErr(err) {
@@ -150,15 +190,17 @@ login:
 		}
 
 	} else {
+		defer release()
+
 		// client already exists, check current user password
 		if cli.Password != "" {
-			if cuinfo.Passwd == "" {
+			if passwd == "" {
 				Rsp{"status": "login", "message": "Password required"}.WriteTo(w)
 				return
 			}
 
-			if cli.Password != cuinfo.Passwd {
-				_, err := cli.Authenticate(ctx, cuinfo.Name, cuinfo.Passwd)
+			if cli.Password != passwd {
+				_, err := cli.Authenticate(ctx, cuinfo.Name, passwd)
 				if err != nil {
 					logger.Warnf("auth failed: %v", err)
 					if isEtcdServerErr(err) {
@@ -172,7 +214,7 @@ login:
 		}
 	}
 
-	info, err := h.getEtcdInfo(ctx, cli, cuinfo.Host)
+	info, err := h.getEtcdInfo(ctx, cli)
 	if err != nil {
 		closeNewCli = true
 		logger.Warnf("get etcd info err: %v", err)
@@ -180,25 +222,31 @@ login:
 		return
 	}
 
-	// set login user info
+	// set login user info, the password only encrypted
+	cuinfo.Secret = h.creds.seal(cuinfo.Host, cuinfo.Name, passwd)
 	_ = sess.Set(cuinfo.Host, &cuinfo)
 	_ = sess.Set("host", cuinfo.Host)
 	// store client
 	if !reuse {
-		if !h.climgr.SetClientNX(cliKey, cli) {
-			// client already exists, close the new client
-			closeNewCli = true
-		}
+		_, release, stored := h.climgr.BorrowOrStore(cliKey, cli)
+		release()
+		// client already exists, close the new client
+		closeNewCli = !stored
+	}
+
+	if prev, switched := h.logins.seen(r, sess.SessionID(), cuinfo.Host, cuinfo.Name); switched {
+		h.release(cuinfo.Host, prev)
 	}
 
 	Rsp{"status": "running", "info": info}.WriteTo(w)
 }
 
 func (h *v3Handlers) Put(w http.ResponseWriter, r *http.Request) {
-	cli, abort := h.getCli(w, r)
+	cli, release, abort := h.getCli(w, r)
 	if abort {
 		return
 	}
+	defer release()
 
 	key := r.FormValue("key")
 	value := r.FormValue("value")
@@ -206,16 +254,48 @@ func (h *v3Handlers) Put(w http.ResponseWriter, r *http.Request) {
 
 	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
 		"method": r.Method,
-		"host":   cli.Endpoints()[0],
+		"host":   cli.Host,
 		"uname":  cli.Username,
 		"key":    key,
 	})
 
 	logger.Debug("PUT v3")
 
+	value, err := decodeValue(value, r.FormValue("encoding"))
+	if err != nil {
+		logger.Warnf("decode value: %v", err)
+		Rsp{"errorCode": 400, "message": "decode value failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	raw := r.FormValue("raw") == "true"
+	value, warnings, err := cf.checkValue(key, value, r.FormValue("format"), r.FormValue("normalize"), raw)
+	if err != nil {
+		logger.Debugf("check value: %v", err)
+		writeErrRsp(w, 422, err)
+		return
+	}
+
 	ctx := r.Context()
+	ws, err := newPolicyCheck(r, cli.Client, &cf).check(opPut, key, "", value)
+	if err != nil {
+		logger.Infof("policy check: %v", err)
+		writePolicyErr(w, err)
+		return
+	}
+	warnings = append(warnings, ws...)
+
+	if !raw {
+		value, err = cf.encodeStored(key, value)
+		if err != nil {
+			logger.Warnf("encode value: %v", err)
+			Rsp{"errorCode": 400, "message": err.Error()}.WriteTo(w)
+			return
+		}
+	}
+
 	var opts []clientv3.OpOption
-	var err error
 	var sec int64
 
 	if ttl != "" {
@@ -225,7 +305,24 @@ func (h *v3Handlers) Put(w http.ResponseWriter, r *http.Request) {
 			Rsp{"errorCode": 500, "message": "ttl parse failed: " + err.Error()}.WriteTo(w)
 			return
 		}
+	}
+
+	// read-only objects are not proposed either
+	if ro, err := isKubernetesObject(ctx, cli.Client, &cf, key); err != nil {
+		logger.Warnf("get failed: %v", err)
+		Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+		return
+	} else if ro {
+		Rsp{"errorCode": 403, "message": "Kubernetes objects are read-only."}.WriteTo(w)
+		return
+	}
+
+	if cf.IsProtected(key) {
+		h.propose(w, r, cli, &proposal{Op: opPut, Key: key, Value: value, Ttl: sec}, warnings)
+		return
+	}
 
+	if sec > 0 {
 		var leaseResp *clientv3.LeaseGrantResponse
 		leaseResp, err = cli.Grant(ctx, sec)
 		if err != nil {
@@ -257,30 +354,30 @@ func (h *v3Handlers) Put(w http.ResponseWriter, r *http.Request) {
 	}
 
 	kv := getRsp.Kvs[0]
-	NodeRsp{
-		Node: Node{
-			Key:           key,
-			Value:         value,
-			Ttl:           sec,
-			CreatedIndex:  kv.CreateRevision,
-			ModifiedIndex: kv.ModRevision,
-			VersionIndex:  kv.Version,
-		},
-	}.WriteTo(w)
+	node := Node{
+		Key:           key,
+		Ttl:           sec,
+		CreatedIndex:  kv.CreateRevision,
+		ModifiedIndex: kv.ModRevision,
+		VersionIndex:  kv.Version,
+	}
+	node.setValue(&cf, kv.Value)
+	NodeRsp{Node: node, Warnings: warnings}.WriteTo(w)
 }
 
 func (h *v3Handlers) Get(w http.ResponseWriter, r *http.Request) {
-	cli, abort := h.getCli(w, r)
+	cli, release, abort := h.getCli(w, r)
 	if abort {
 		return
 	}
+	defer release()
 
 	key := r.FormValue("key")
 	withPrefix := r.FormValue("prefix") == "true"
 
 	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
 		"method": r.Method,
-		"host":   cli.Endpoints()[0],
+		"host":   cli.Host,
 		"uname":  cli.Username,
 		"key":    key,
 	})
@@ -311,16 +408,16 @@ func (h *v3Handlers) Get(w http.ResponseWriter, r *http.Request) {
 
 			ttl = leaseRsp.TTL
 		}
-		NodeRsp{
-			Node: Node{
-				Key:           key,
-				Value:         strz.UnsafeString(getRsp.Kvs[0].Value),
-				Ttl:           ttl,
-				CreatedIndex:  getRsp.Kvs[0].CreateRevision,
-				ModifiedIndex: getRsp.Kvs[0].ModRevision,
-				VersionIndex:  getRsp.Kvs[0].Version,
-			},
-		}.WriteTo(w)
+		node := Node{
+			Key:           key,
+			Ttl:           ttl,
+			CreatedIndex:  getRsp.Kvs[0].CreateRevision,
+			ModifiedIndex: getRsp.Kvs[0].ModRevision,
+			VersionIndex:  getRsp.Kvs[0].Version,
+		}
+		cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+		node.setValue(&cf, getRsp.Kvs[0].Value)
+		NodeRsp{Node: node}.WriteTo(w)
 		return
 	}
 
@@ -332,7 +429,7 @@ func (h *v3Handlers) Get(w http.ResponseWriter, r *http.Request) {
 			clientv3.WithKeysOnly(),
 		)
 	} else {
-		keyRanges, err := getPermissionKeys(ctx, cli)
+		keyRanges, err := getPermissionKeys(ctx, cli.Client)
 		if err != nil {
 			logger.Warnf("get permission keys failed: %v", err)
 			Rsp{"errorCode": 500, "message": "get permission keys failed: " + err.Error()}.WriteTo(w)
@@ -375,7 +472,7 @@ func (h *v3Handlers) Get(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	cf, ok := h.conf.GetEtcdConfig(cli.Endpoints()[0])
+	cf, ok := h.conf.Load().GetEtcdConfig(cli.Host)
 	if !ok {
 		cf.Separator = "/"
 	}
@@ -388,125 +485,160 @@ func (h *v3Handlers) Get(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *v3Handlers) Del(w http.ResponseWriter, r *http.Request) {
-	cli, abort := h.getCli(w, r)
+	cli, release, abort := h.getCli(w, r)
 	if abort {
 		return
 	}
+	defer release()
 
 	key := r.FormValue("key")
-	dir := r.FormValue("dir")
+	dir := r.FormValue("dir") == "true"
 
 	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
 		"method": r.Method,
-		"host":   cli.Endpoints()[0],
+		"host":   cli.Host,
 		"uname":  cli.Username,
 		"key":    key,
 	})
 
 	logger.Debug("DELETE v3")
 
+	var end string
+	if dir {
+		end = clientv3.GetPrefixRangeEnd(key)
+	}
+
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	if dir && cf.OverlapsProtected(key, end) {
+		_, _ = io.WriteString(w, "Directories containing protected keys can not be deleted, delete the keys one by one.")
+		return
+	}
+
+	if cf.Trash.touches(key, end) {
+		_, _ = io.WriteString(w, "Keys of the trash can not be deleted, they expire after the retention period.")
+		return
+	}
+
 	ctx := r.Context()
-	if _, err := cli.Delete(ctx, key); err != nil {
-		_, _ = io.WriteString(w, err.Error())
+	warnings, err := newPolicyCheck(r, cli.Client, &cf).check(opDelete, key, end, "")
+	if err != nil {
+		logger.Infof("policy check: %v", err)
+		writePolicyErr(w, err)
 		return
 	}
 
-	if dir == "true" {
-		if _, err := cli.Delete(ctx, key, clientv3.WithPrefix()); err != nil {
-			_, _ = io.WriteString(w, err.Error())
+	if cf.IsProtected(key) {
+		h.propose(w, r, cli, &proposal{Op: opDelete, Key: key}, warnings)
+		return
+	}
+
+	// directory deletes are previewed and must be confirmed at the revision of the preview
+	if dir && r.FormValue("confirm") != "true" {
+		previewDelete(ctx, w, cli.Client, &cf, key)
+		return
+	}
+
+	var rev int64
+	if v := r.FormValue("rev"); v != "" {
+		rev, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			_, _ = io.WriteString(w, "invalid rev: "+v)
 			return
 		}
 	}
 
+	n, err := deleteKeys(ctx, cli.Client, &cf, identity(r, cli.Client), key, dir, rev)
+	if errors.Is(err, errKeysChanged) {
+		Rsp{"errorCode": 409, "message": "Keys were changed after the delete was previewed, please try again."}.WriteTo(w)
+		return
+	}
+	if errors.Is(err, errTrashTooLarge) {
+		Rsp{"errorCode": 413, "message": err.Error()}.WriteTo(w)
+		return
+	}
+	if err != nil {
+		logger.Warnf("delete failed: %v", err)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	}
+
+	logger.Infof("deleted %d keys", n)
+	if len(warnings) > 0 {
+		Rsp{"status": "ok", "warnings": warnings}.WriteTo(w)
+		return
+	}
 	_, _ = io.WriteString(w, "ok")
 }
 
 func (h *v3Handlers) GetPath(w http.ResponseWriter, r *http.Request) {
-	cli, abort := h.getCli(w, r)
+	cli, release, abort := h.getCli(w, r)
 	if abort {
 		return
 	}
+	defer release()
 
 	key := r.FormValue("key")
 
 	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
 		"method": r.Method,
-		"host":   cli.Endpoints()[0],
+		"host":   cli.Host,
 		"uname":  cli.Username,
 		"key":    key,
 	})
 
 	logger.Debug("GET v3")
 
-	getRsp := &clientv3.GetResponse{}
-	var err error
-	ctx := r.Context()
-	if cli.Username == "" || cli.Username == "root" {
-		getRsp, err = cli.Get(ctx, key,
-			clientv3.WithPrefix(),
-			clientv3.WithKeysOnly(),
-		)
-	} else {
-		keyRanges, err := getPermissionKeys(ctx, cli)
-		if err != nil {
-			logger.Warnf("get permission keys failed: %v", err)
-			Rsp{"errorCode": 500, "message": "get permission keys failed: " + err.Error()}.WriteTo(w)
+	limit := int64(treeDefaultLimit)
+	if l := r.FormValue("limit"); l != "" {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || n <= 0 {
+			Rsp{"errorCode": 400, "message": "invalid limit: " + l}.WriteTo(w)
 			return
 		}
-
-		keyRanges = slices.DeleteFunc(keyRanges, func(kr keyRange) bool {
-			return !strings.HasPrefix(kr.from, key)
-		})
-
-		for _, kr := range keyRanges {
-			rsp, err := cli.Get(ctx, kr.from,
-				clientv3.WithFromKey(),
-				clientv3.WithRange(kr.end),
-				clientv3.WithKeysOnly(),
-			)
-			if err != nil {
-				logger.Warnf("range get failed: %v", err)
-				Rsp{"errorCode": 500, "message": "range get failed: " + err.Error()}.WriteTo(w)
-				return
-			}
-
-			getRsp.Kvs = append(getRsp.Kvs, rsp.Kvs...)
-		}
-
+		limit = min(n, treeMaxLimit)
 	}
 
+	ctx := r.Context()
+	ranges, err := readableRanges(ctx, cli.Client, key)
 	if err != nil {
-		logger.Warnf("get failed: %v", err)
-		Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+		logger.Warnf("get permission keys failed: %v", err)
+		Rsp{"errorCode": 500, "message": "get permission keys failed: " + err.Error()}.WriteTo(w)
 		return
 	}
 
-	cf, ok := h.conf.GetEtcdConfig(cli.Endpoints()[0])
+	cf, ok := h.conf.Load().GetEtcdConfig(cli.Host)
 	if !ok {
 		cf.Separator = "/"
 	}
 
-	nodes, _ := buildNodes([]byte(key), []byte(cf.Separator), 0, getRsp.Kvs)
-	if key == "" && len(nodes) == 0 {
+	nodes, next, err := listLevel(ctx, cli.Client, ranges, key, cf.Separator, r.FormValue("continue"), limit)
+	if err != nil {
+		logger.Warnf("get failed: %v", err)
+		Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	if key == "" && len(nodes) == 0 && next == "" {
 		nodes = append(nodes, &Node{
 			Key: cf.Separator,
 			Dir: true,
 		})
 	}
-	NodesRsp{Nodes: nodes}.WriteTo(w)
+	NodesRsp{Nodes: nodes, Next: next}.WriteTo(w)
 }
 
 func (h *v3Handlers) History(w http.ResponseWriter, r *http.Request) {
-	cli, abort := h.getCli(w, r)
+	cli, release, abort := h.getCli(w, r)
 	if abort {
 		return
 	}
+	defer release()
 
 	key := r.FormValue("key")
 
 	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
 		"method": r.Method,
-		"host":   cli.Endpoints()[0],
+		"host":   cli.Host,
 		"uname":  cli.Username,
 		"key":    key,
 	})
@@ -527,6 +659,7 @@ func (h *v3Handlers) History(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
 	var nodes []*Node
 	revision := getRsp.Kvs[0].CreateRevision
 	version := getRsp.Kvs[0].Version
@@ -536,13 +669,14 @@ eventLoop:
 	for wresp := range wch {
 		for _, ev := range wresp.Events {
 			if ev.Type == mvccpb.PUT {
-				nodes = append(nodes, &Node{
+				node := &Node{
 					Key:           strz.UnsafeString(ev.Kv.Key),
-					Value:         strz.UnsafeString(ev.Kv.Value),
 					CreatedIndex:  ev.Kv.CreateRevision,
 					ModifiedIndex: ev.Kv.ModRevision,
 					VersionIndex:  ev.Kv.Version,
-				})
+				}
+				node.setValue(&cf, ev.Kv.Value)
+				nodes = append(nodes, node)
 
 				if ev.Kv.Version >= version {
 					break eventLoop
@@ -558,8 +692,19 @@ eventLoop:
 	Rsp{"rows": nodes, "total": len(nodes)}.WriteTo(w)
 }
 
-func (h *v3Handlers) getEtcdInfo(ctx context.Context, cli *clientv3.Client, host string) (map[string]string, error) {
-	stRsp, err := cli.Status(ctx, host)
+func (h *v3Handlers) getEtcdInfo(ctx context.Context, cli *clientv3.Client) (map[string]string, error) {
+	// the status of the first member that answers, the others may be down
+	var stRsp *clientv3.StatusResponse
+	var err error
+	for _, ep := range cli.Endpoints() {
+		sctx, cancel := context.WithTimeout(ctx, statusTimeout)
+		stRsp, err = cli.Status(sctx, ep)
+		cancel()
+		if err == nil {
+			break
+		}
+		olog.Debugf("status of %s: %v", ep, err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -585,7 +730,16 @@ func (h *v3Handlers) getEtcdInfo(ctx context.Context, cli *clientv3.Client, host
 	return info, nil
 }
 
-func (h *v3Handlers) getCli(w http.ResponseWriter, r *http.Request) (*clientv3.Client, bool) {
+// etcdClient is the client of a session with the cluster it is logged in to.
+type etcdClient struct {
+	*clientv3.Client
+	// Host is the name of a configured cluster, or the endpoints of another.
+	Host string
+}
+
+// getCli returns the client of the session, release must be called when the
+// request is done with it.
+func (h *v3Handlers) getCli(w http.ResponseWriter, r *http.Request) (cli *etcdClient, release func(), abort bool) {
 	abortRsp := Rsp{"errorCode": 401, "message": "Please reconnect to etcd"}
 
 	sess := h.sessmgr.SessionStart(w, r)
@@ -593,28 +747,69 @@ func (h *v3Handlers) getCli(w http.ResponseWriter, r *http.Request) (*clientv3.C
 	if !ok {
 		olog.Debugf("no host in session")
 		abortRsp.WriteTo(w)
-		return nil, true
+		return nil, nil, true
 	}
 
 	infoValue, ok := sess.Get(host.(string))
 	if !ok {
 		olog.Debugf("no host info in session")
 		abortRsp.WriteTo(w)
-		return nil, true
+		return nil, nil, true
 	}
 
-	cliKey := genCliKey(host.(string), infoValue.(*userInfo).Name)
-	cli, ok := h.climgr.GetClient(cliKey)
-	if !ok {
+	c, release, err := h.sessionCli(infoValue.(*userInfo))
+	if err != nil {
+		olog.Debugf("reconnect from session failed: %v", err)
 		abortRsp.WriteTo(w)
-		return nil, true
+		return nil, nil, true
 	}
 
-	return cli, false
+	h.logins.seen(r, sess.SessionID(), host.(string), c.Username)
+	return &etcdClient{Client: c, Host: h.conf.Load().ClusterName(host.(string))}, release, false
 }
 
+// sessionCli returns the client of the user logged in to a host, it reconnects
+// when the client was closed as idle or the session outlived a restart.
+func (h *v3Handlers) sessionCli(uinfo *userInfo) (*clientv3.Client, func(), error) {
+	cliKey := genCliKey(uinfo.Host, uinfo.Name)
+	if cli, release, ok := h.climgr.Borrow(cliKey); ok {
+		return cli, release, nil
+	}
+
+	cf, ok := h.conf.Load().GetEtcdConfig(uinfo.Host)
+	if !ok {
+		if uinfo.Cluster {
+			return nil, nil, fmt.Errorf("etcd %s is no longer configured", uinfo.Host)
+		}
+		cf.Endpoints = splitEndpoints(uinfo.Host)
+	}
+
+	passwd, err := h.creds.open(uinfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cli, err := newEtcdClient(uinfo.Name, passwd, cf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stored, release, ok := h.climgr.BorrowOrStore(cliKey, cli)
+	if !ok {
+		// another request reconnected first
+		_ = cli.Close()
+	}
+	return stored, release, nil
+}
+
+// genCliKey quotes the host, so the clients of a host are found by the prefix of
+// cliKeyPrefix whatever characters the names contain.
 func genCliKey(host, user string) string {
-	return fmt.Sprintf("%s-%s", host, user)
+	return cliKeyPrefix(host) + strconv.Quote(user)
+}
+
+func cliKeyPrefix(host string) string {
+	return strconv.Quote(host) + "-"
 }
 
 func getPermissionKeys(ctx context.Context, cli *clientv3.Client) ([]keyRange, error) {
@@ -643,41 +838,86 @@ func getPermissionKeys(ctx context.Context, cli *clientv3.Client) ([]keyRange, e
 	return keys, nil
 }
 
-func buildNodes(prefix, separator []byte, idx int, kvs []*mvccpb.KeyValue) ([]*Node, int) {
-	var nodes []*Node
-	i := idx
-	for i < len(kvs) {
-		kv := kvs[i]
-		if !bytes.HasPrefix(kv.Key, prefix) {
-			return nodes, i - idx
+// listLevel lists the direct children of prefix in key order: keys without a further
+// separator become leaves and the rest are grouped into directories with the number
+// of keys they contain. At most limit nodes are returned, next is the key to continue
+// from when there are more.
+func listLevel(ctx context.Context, cli *clientv3.Client, ranges []keyRange, prefix, separator, from string,
+	limit int64) (nodes []*Node, next string, err error) {
+	for _, kr := range ranges {
+		if from != "" && !rangeEndLess(from, kr.end) {
+			continue
 		}
 
-		rest := kv.Key[len(prefix):]
-		offset := bytes.Index(rest, separator)
-		if offset < 0 || offset == len(rest)-1 {
-			if len(rest) > 0 {
+		start := max(kr.from, from)
+		if start == "" {
+			// etcd rejects an empty key, "\x00" is the smallest valid one
+			start = "\x00"
+		}
+	page:
+		for kr.end == "\x00" || start < kr.end {
+			rsp, err := cli.Get(ctx, start,
+				clientv3.WithRange(kr.end),
+				clientv3.WithKeysOnly(),
+				clientv3.WithLimit(min(limit+1, scanPageSize)),
+			)
+			if err != nil {
+				return nil, "", err
+			}
+
+			for _, kv := range rsp.Kvs {
+				if int64(len(nodes)) == limit {
+					return nodes, string(kv.Key), nil
+				}
+
+				key := strz.UnsafeString(kv.Key)
+				rest := key[len(prefix):]
+				offset := strings.Index(rest, separator)
+				if offset < 0 || offset == len(rest)-len(separator) {
+					if len(rest) > 0 {
+						nodes = append(nodes, &Node{
+							Key:           key,
+							CreatedIndex:  kv.CreateRevision,
+							ModifiedIndex: kv.ModRevision,
+							VersionIndex:  kv.Version,
+						})
+					}
+					start = key + "\x00"
+					continue
+				}
+
+				dir := key[:len(prefix)+offset+len(separator)]
+				end := clientv3.GetPrefixRangeEnd(dir)
+				if rangeEndLess(kr.end, end) {
+					end = kr.end
+				}
+
+				// a range granted inside the directory only counts its own keys
+				countRsp, err := cli.Get(ctx, max(dir, kr.from), clientv3.WithRange(end), clientv3.WithCountOnly())
+				if err != nil {
+					return nil, "", err
+				}
+
 				nodes = append(nodes, &Node{
-					Key:           strz.UnsafeString(kv.Key),
-					CreatedIndex:  kv.CreateRevision,
-					ModifiedIndex: kv.ModRevision,
-					VersionIndex:  kv.Version,
+					Key:   dir,
+					Dir:   true,
+					Count: countRsp.Count,
 				})
+
+				if end == "\x00" {
+					break page
+				}
+
+				// skip the keys of the directory
+				start = end
+				continue page
 			}
-			i++
-			continue
-		}
 
-		offset = offset + len(prefix) + 1
-		node := &Node{
-			Key: strz.UnsafeString(kv.Key[:offset]),
-			Dir: true,
+			if !rsp.More {
+				break
+			}
 		}
-		children, n := buildNodes(kv.Key[:offset], separator, i, kvs)
-		node.Nodes = children
-		nodes = append(nodes, node)
-
-		i += n
 	}
 
-	return nodes, i
+	return nodes, "", nil
 }
@@ -0,0 +1,140 @@
+package srv
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+)
+
+// fakeKV serves ranges of a fixed set of keys, the other calls of the interface panic.
+type fakeKV struct {
+	pb.KVClient
+	keys  []string
+	calls int
+}
+
+func (f *fakeKV) Range(_ context.Context, req *pb.RangeRequest, _ ...grpc.CallOption) (*pb.RangeResponse, error) {
+	f.calls++
+	from, end := string(req.Key), string(req.RangeEnd)
+	rsp := &pb.RangeResponse{Header: &pb.ResponseHeader{Revision: 1}}
+	for _, k := range f.keys {
+		in := k == from
+		if end != "" {
+			in = k >= from && (end == "\x00" || k < end)
+		}
+		if !in {
+			continue
+		}
+
+		rsp.Count++
+		if req.CountOnly || (req.Limit > 0 && int64(len(rsp.Kvs)) == req.Limit) {
+			continue
+		}
+		kv := &mvccpb.KeyValue{Key: []byte(k), CreateRevision: 1, ModRevision: 1, Version: 1}
+		if !req.KeysOnly {
+			kv.Value = []byte("v")
+		}
+		rsp.Kvs = append(rsp.Kvs, kv)
+	}
+	rsp.More = !req.CountOnly && rsp.Count > int64(len(rsp.Kvs))
+	return rsp, nil
+}
+
+func newFakeClient(keys ...string) (*clientv3.Client, *fakeKV) {
+	slices.Sort(keys)
+	kv := &fakeKV{keys: keys}
+	cli := &clientv3.Client{}
+	cli.KV = clientv3.NewKVFromKVClient(kv, cli)
+	return cli, kv
+}
+
+func TestListLevel(t *testing.T) {
+	cli, _ := newFakeClient(
+		"/a", "/b/", "/b/x", "/b/y/z", "/c", "/d/1", "/d/2", "/d/3", "/e",
+	)
+	all := []keyRange{{from: "/", end: clientv3.GetPrefixRangeEnd("/")}}
+
+	tests := []struct {
+		name   string
+		ranges []keyRange
+		prefix string
+		from   string
+		limit  int64
+		want   []string
+		next   string
+	}{
+		{name: "level", ranges: all, prefix: "/", limit: 10, want: []string{"/a", "/b/", "/b/ (3)", "/c", "/d/ (3)", "/e"}},
+		{name: "sub level", ranges: []keyRange{{from: "/b/", end: "/b0"}}, prefix: "/b/", limit: 10, want: []string{"/b/x", "/b/y/ (1)"}},
+		{name: "limit", ranges: all, prefix: "/", limit: 2, want: []string{"/a", "/b/"}, next: "/b/x"},
+		{name: "limit after directory", ranges: all, prefix: "/", limit: 3, want: []string{"/a", "/b/", "/b/ (3)"}, next: "/c"},
+		{name: "continue", ranges: all, prefix: "/", from: "/c", limit: 2, want: []string{"/c", "/d/ (3)"}, next: "/e"},
+		{name: "continue at end", ranges: all, prefix: "/", from: "/e", limit: 2, want: []string{"/e"}},
+		{
+			name:   "permitted ranges",
+			ranges: []keyRange{{from: "/a", end: "/a\x00"}, {from: "/d/2", end: "/e"}},
+			prefix: "/",
+			limit:  10,
+			want:   []string{"/a", "/d/ (2)"},
+		},
+		{
+			name:   "continue skips ranges",
+			ranges: []keyRange{{from: "/a", end: "/a\x00"}, {from: "/d/2", end: "/e"}},
+			prefix: "/",
+			from:   "/b",
+			limit:  10,
+			want:   []string{"/d/ (2)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, next, err := listLevel(context.Background(), cli, tt.ranges, tt.prefix, "/", tt.from, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, n := range nodes {
+				s := n.Key
+				if n.Dir {
+					s += " (" + strconv.FormatInt(n.Count, 10) + ")"
+				}
+				got = append(got, s)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("nodes = %q, want %q", got, tt.want)
+			}
+			if next != tt.next {
+				t.Errorf("next = %q, want %q", next, tt.next)
+			}
+		})
+	}
+}
+
+// TestListLevelSkipsDirectories checks that the keys of a directory are counted
+// instead of being read page by page.
+func TestListLevelSkipsDirectories(t *testing.T) {
+	keys := []string{"/a"}
+	for i := 0; i < 3*scanPageSize; i++ {
+		keys = append(keys, "/big/"+strconv.Itoa(100000+i))
+	}
+	cli, kv := newFakeClient(append(keys, "/z")...)
+
+	nodes, _, err := listLevel(context.Background(), cli, []keyRange{{from: "/", end: "0"}}, "/", "/", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 || nodes[1].Count != 3*scanPageSize {
+		t.Fatalf("nodes = %+v", nodes)
+	}
+	// a page, the count of /big/, a page from /big0
+	if kv.calls != 3 {
+		t.Errorf("calls = %d, want 3", kv.calls)
+	}
+}
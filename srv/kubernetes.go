@@ -0,0 +1,361 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/protobuf/encoding/protowire"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	formatKubernetes = "kubernetes"
+	// kubernetesPrefix is the default --etcd-prefix of kube-apiserver.
+	kubernetesPrefix = "/registry/"
+)
+
+// kubernetesMagic prefixes protobuf encoded objects written by kube-apiserver.
+var kubernetesMagic = []byte("k8s\x00")
+
+var errNotKubernetes = errors.New("not a kubernetes protobuf object")
+
+// objectMetaFields names the fields of metav1.ObjectMeta, every kubernetes object
+// keeps it as its first field.
+var objectMetaFields = map[protowire.Number]string{
+	1:  "name",
+	2:  "generateName",
+	3:  "namespace",
+	4:  "selfLink",
+	5:  "uid",
+	6:  "resourceVersion",
+	7:  "generation",
+	8:  "creationTimestamp",
+	9:  "deletionTimestamp",
+	10: "deletionGracePeriodSeconds",
+	11: "labels",
+	12: "annotations",
+	13: "ownerReferences",
+	14: "finalizers",
+	17: "managedFields",
+}
+
+// kubernetesFields names the fields after metadata of common kinds. Fields of
+// other kinds, and the fields of nested messages, are keyed by field number.
+var kubernetesFields = map[string]map[protowire.Number]string{
+	"ConfigMap":               {2: "data", 3: "binaryData", 4: "immutable"},
+	"Secret":                  {2: "data", 3: "type", 4: "stringData", 5: "immutable"},
+	"Lease":                   {2: "spec"},
+	"Pod":                     specStatusFields,
+	"Service":                 specStatusFields,
+	"Node":                    specStatusFields,
+	"Namespace":               specStatusFields,
+	"PersistentVolume":        specStatusFields,
+	"PersistentVolumeClaim":   specStatusFields,
+	"ReplicationController":   specStatusFields,
+	"Deployment":              specStatusFields,
+	"ReplicaSet":              specStatusFields,
+	"StatefulSet":             specStatusFields,
+	"DaemonSet":               specStatusFields,
+	"Job":                     specStatusFields,
+	"CronJob":                 specStatusFields,
+	"HorizontalPodAutoscaler": specStatusFields,
+}
+
+var specStatusFields = map[protowire.Number]string{2: "spec", 3: "status"}
+
+// schemalessComment heads the YAML of objects with fields decoded without schema.
+const schemalessComment = "Fields keyed by numbers are protobuf fields decoded without schema,\n" +
+	"as protoc --decode_raw does. The value is read-only."
+
+func isKubernetesValue(b []byte) bool {
+	return bytes.HasPrefix(b, kubernetesMagic)
+}
+
+// isKubernetesObject reports whether key holds an object written by kube-apiserver.
+// Such objects are read-only, writing them would break the cluster.
+func isKubernetesObject(ctx context.Context, cli *clientv3.Client, cf *Etcd, key string) (bool, error) {
+	if !strings.HasPrefix(key, cf.KubernetesPrefix) {
+		return false, nil
+	}
+
+	getRsp, err := cli.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return len(getRsp.Kvs) > 0 && isKubernetesValue(getRsp.Kvs[0].Value), nil
+}
+
+// decodeKubernetes renders a protobuf encoded kubernetes object as YAML. The
+// envelope (runtime.Unknown), the object metadata and the fields of common kinds
+// are decoded by name, the rest is decoded without schema and keyed by field
+// number under a comment saying so.
+func decodeKubernetes(b []byte) (string, error) {
+	if !isKubernetesValue(b) {
+		return "", errNotKubernetes
+	}
+
+	var apiVersion, kind string
+	var raw []byte
+	err := rangeFields(b[len(kubernetesMagic):], func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType: // typeMeta
+			return rangeFields(v, func(num protowire.Number, _ protowire.Type, v []byte) error {
+				if num == 1 {
+					apiVersion = string(v)
+				} else if num == 2 {
+					kind = string(v)
+				}
+				return nil
+			})
+		case num == 2 && typ == protowire.BytesType:
+			raw = v
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	doc := mappingNode()
+	appendField(doc, "apiVersion", scalarNode(apiVersion))
+	appendField(doc, "kind", scalarNode(kind))
+
+	fields := kubernetesFields[kind]
+	maps := make(map[string]*yaml.Node, 2)
+	var schemaless bool
+	err = rangeFields(raw, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num == 1 && typ == protowire.BytesType {
+			appendField(doc, "metadata", decodeObjectMeta(v))
+			return nil
+		}
+
+		name, ok := fields[num]
+		switch {
+		case !ok:
+			schemaless = true
+			appendRepeated(doc, strconv.Itoa(int(num)), decodeRawField(typ, v))
+		case name == "data" || name == "binaryData" || name == "stringData":
+			// secret data and binary data are bytes, shown base64 encoded like kubectl does
+			binary := name == "binaryData" || (kind == "Secret" && name == "data")
+			appendMapEntry(doc, maps, name, v, binary)
+		case name == "immutable":
+			n, _ := protowire.ConsumeVarint(v)
+			appendField(doc, name, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(n != 0)})
+		case name == "type":
+			appendField(doc, name, scalarNode(string(v)))
+		default:
+			schemaless = true
+			appendField(doc, name, decodeRawField(typ, v))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if schemaless {
+		doc.HeadComment = schemalessComment
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func decodeObjectMeta(b []byte) *yaml.Node {
+	meta := mappingNode()
+	maps := make(map[string]*yaml.Node, 2)
+	_ = rangeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if len(v) == 0 {
+			return nil
+		}
+
+		name, ok := objectMetaFields[num]
+		if !ok {
+			appendField(meta, strconv.Itoa(int(num)), decodeRawField(typ, v))
+			return nil
+		}
+
+		switch name {
+		case "labels", "annotations":
+			appendMapEntry(meta, maps, name, v, false)
+		case "creationTimestamp", "deletionTimestamp":
+			appendField(meta, name, scalarNode(decodeTime(v)))
+		case "generation", "deletionGracePeriodSeconds":
+			appendField(meta, name, decodeRawField(typ, v))
+		case "ownerReferences", "finalizers", "managedFields":
+			appendRepeated(meta, name, decodeRawField(typ, v))
+		default:
+			appendField(meta, name, scalarNode(string(v)))
+		}
+		return nil
+	})
+	return meta
+}
+
+// appendMapEntry adds an entry of the protobuf map field name to the mapping
+// stored under name in m, creating it on the first entry. Binary values are base64
+// encoded.
+func appendMapEntry(m *yaml.Node, maps map[string]*yaml.Node, name string, entry []byte, binary bool) {
+	mm, ok := maps[name]
+	if !ok {
+		mm = mappingNode()
+		maps[name] = mm
+		appendField(m, name, mm)
+	}
+
+	var k string
+	var val []byte
+	_ = rangeFields(entry, func(num protowire.Number, _ protowire.Type, v []byte) error {
+		if num == 1 {
+			k = string(v)
+		} else if num == 2 {
+			val = v
+		}
+		return nil
+	})
+
+	if binary {
+		appendField(mm, k, scalarNode(base64.StdEncoding.EncodeToString(val)))
+	} else {
+		appendField(mm, k, scalarNode(string(val)))
+	}
+}
+
+// decodeTime decodes a metav1.Time message.
+func decodeTime(b []byte) string {
+	var sec, nsec int64
+	_ = rangeFields(b, func(num protowire.Number, _ protowire.Type, v []byte) error {
+		n, _ := protowire.ConsumeVarint(v)
+		if num == 1 {
+			sec = int64(n)
+		} else if num == 2 {
+			nsec = int64(n)
+		}
+		return nil
+	})
+	return time.Unix(sec, nsec).UTC().Format(time.RFC3339)
+}
+
+// decodeRawField decodes a field without schema, the way protoc --decode_raw does.
+func decodeRawField(typ protowire.Type, v []byte) *yaml.Node {
+	switch typ {
+	case protowire.VarintType:
+		n, _ := protowire.ConsumeVarint(v)
+		return intNode(strconv.FormatUint(n, 10))
+	case protowire.Fixed32Type:
+		n, _ := protowire.ConsumeFixed32(v)
+		return intNode(strconv.FormatUint(uint64(n), 10))
+	case protowire.Fixed64Type:
+		n, _ := protowire.ConsumeFixed64(v)
+		return intNode(strconv.FormatUint(n, 10))
+	}
+
+	if isPrintable(v) {
+		return scalarNode(string(v))
+	}
+
+	msg := mappingNode()
+	err := rangeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		appendRepeated(msg, strconv.Itoa(int(num)), decodeRawField(typ, v))
+		return nil
+	})
+	if err != nil || len(msg.Content) == 0 {
+		return scalarNode(base64.StdEncoding.EncodeToString(v))
+	}
+	return msg
+}
+
+// rangeFields calls fn for every field of a protobuf message. For varint and fixed
+// fields v holds the encoded number, for length delimited fields the payload.
+func rangeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func mappingNode() *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode}
+}
+
+func scalarNode(v string) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+	if strings.Contains(v, "\n") {
+		n.Style = yaml.LiteralStyle
+	}
+	return n
+}
+
+func intNode(v string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: v}
+}
+
+func appendField(m *yaml.Node, key string, v *yaml.Node) {
+	m.Content = append(m.Content, scalarNode(key), v)
+}
+
+// appendRepeated appends v to the sequence stored under key, turning a
+// field seen twice into a sequence.
+func appendRepeated(m *yaml.Node, key string, v *yaml.Node) {
+	for i := 0; i < len(m.Content); i += 2 {
+		if m.Content[i].Value != key {
+			continue
+		}
+
+		old := m.Content[i+1]
+		if old.Kind != yaml.SequenceNode {
+			m.Content[i+1] = &yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{old}}
+		}
+		m.Content[i+1].Content = append(m.Content[i+1].Content, v)
+		return
+	}
+	appendField(m, key, v)
+}
@@ -0,0 +1,137 @@
+package srv
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pbField appends a length delimited field.
+func pbField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// pbVarint appends a varint field.
+func pbVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func pbEntry(k, v string) []byte {
+	return pbField(pbField(nil, 1, []byte(k)), 2, []byte(v))
+}
+
+// kubernetesObject builds the value kube-apiserver stores for an object of kind
+// with the given metadata and fields after it.
+func kubernetesObject(kind string, meta, fields []byte) []byte {
+	typeMeta := pbField(pbField(nil, 1, []byte("v1")), 2, []byte(kind))
+	raw := append(pbField(nil, 1, meta), fields...)
+	b := append([]byte(nil), kubernetesMagic...)
+	b = pbField(b, 1, typeMeta)
+	return pbField(b, 2, raw)
+}
+
+func TestDecodeKubernetes(t *testing.T) {
+	meta := pbField(nil, 1, []byte("cfg"))
+	meta = pbField(meta, 3, []byte("default"))
+	meta = pbField(meta, 8, pbVarint(nil, 1, 1700000000))
+	meta = pbField(meta, 11, pbEntry("app", "web"))
+	meta = pbField(meta, 11, pbEntry("tier", "front"))
+
+	tests := []struct {
+		name  string
+		value []byte
+		want  string
+	}{
+		{
+			name: "config map",
+			value: kubernetesObject("ConfigMap", meta,
+				pbVarint(pbField(pbField(nil, 2, pbEntry("a", "1")), 2, pbEntry("b", "2")), 4, 1)),
+			want: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cfg
+  namespace: default
+  creationTimestamp: "2023-11-14T22:13:20Z"
+  labels:
+    app: web
+    tier: front
+data:
+  a: "1"
+  b: "2"
+immutable: true
+`,
+		},
+		{
+			name:  "secret data is base64",
+			value: kubernetesObject("Secret", pbField(nil, 1, []byte("s")), pbField(pbField(nil, 2, pbEntry("pw", "\x00\x01")), 3, []byte("Opaque"))),
+			want: `apiVersion: v1
+kind: Secret
+metadata:
+  name: s
+data:
+  pw: AAE=
+type: Opaque
+`,
+		},
+		{
+			name:  "unknown fields",
+			value: kubernetesObject("Widget", pbField(nil, 1, []byte("w")), pbVarint(pbField(nil, 2, []byte("text")), 3, 42)),
+			want: `# Fields keyed by numbers are protobuf fields decoded without schema,
+# as protoc --decode_raw does. The value is read-only.
+apiVersion: v1
+kind: Widget
+metadata:
+  name: w
+"2": text
+"3": 42
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeKubernetes(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeKubernetesInvalid(t *testing.T) {
+	for _, value := range [][]byte{
+		[]byte(`{"kind":"ConfigMap"}`),
+		append(append([]byte(nil), kubernetesMagic...), 0x0a, 0x05, 'v'),
+	} {
+		if s, err := decodeKubernetes(value); err == nil {
+			t.Errorf("decodeKubernetes(%q) = %q, want an error", value, s)
+		}
+	}
+}
+
+func TestSetValueKubernetesPrefix(t *testing.T) {
+	cf := Etcd{}
+	cf.Default()
+	value := kubernetesObject("ConfigMap", pbField(nil, 1, []byte("cfg")), nil)
+
+	tests := []struct {
+		key      string
+		readOnly bool
+	}{
+		{key: "/registry/configmaps/default/cfg", readOnly: true},
+		// values elsewhere may start with the magic by chance
+		{key: "/app/cfg", readOnly: false},
+	}
+	for _, tt := range tests {
+		n := Node{Key: tt.key}
+		n.setValue(&cf, value)
+		if n.ReadOnly != tt.readOnly || (n.Format == formatKubernetes) != tt.readOnly {
+			t.Errorf("%s: readOnly = %v, format = %q, want readOnly %v", tt.key, n.ReadOnly, n.Format, tt.readOnly)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package srv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/welllog/olog"
+)
+
+// login is a user of a session connected to a host, as seen by this process.
+type login struct {
+	// ID identifies the session without revealing its id.
+	ID         string `json:"id"`
+	Host       string `json:"host"`
+	User       string `json:"user"`
+	Identity   string `json:"identity,omitempty"`
+	RemoteAddr string `json:"remoteAddr"`
+	LoginAt    int64  `json:"loginAt"`
+	LastSeen   int64  `json:"lastSeen"`
+	Current    bool   `json:"current,omitempty"`
+}
+
+// loginRegistry tracks which sessions use the clients of the EtcdManager, so a
+// client can be closed once the last session using it logs out.
+type loginRegistry struct {
+	mu       sync.Mutex
+	lifetime int64
+	logins   map[string]map[string]*login // session id -> host -> login
+}
+
+func newLoginRegistry(lifetime int64) *loginRegistry {
+	return &loginRegistry{lifetime: lifetime, logins: make(map[string]map[string]*login)}
+}
+
+// seen records a request of the session to host. It returns the user the session
+// was logged in as before if that changed.
+func (l *loginRegistry) seen(r *http.Request, sid, host, user string) (prev string, switched bool) {
+	now := time.Now().Unix()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hosts, ok := l.logins[sid]
+	if !ok {
+		hosts = make(map[string]*login, 1)
+		l.logins[sid] = hosts
+	}
+
+	e, ok := hosts[host]
+	if ok && e.User != user {
+		prev, switched = e.User, true
+		ok = false
+	}
+	if !ok {
+		e = &login{ID: loginID(sid), Host: host, User: user, LoginAt: now}
+		hosts[host] = e
+	}
+	e.Identity = certIdentity(r.Context())
+	e.RemoteAddr = r.RemoteAddr
+	e.LastSeen = now
+	return
+}
+
+// remove forgets the logins of the session to host, or to all hosts if host is empty.
+func (l *loginRegistry) remove(sid, host string) []login {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var removed []login
+	for h, e := range l.logins[sid] {
+		if host == "" || h == host {
+			removed = append(removed, *e)
+			delete(l.logins[sid], h)
+		}
+	}
+	if len(l.logins[sid]) == 0 {
+		delete(l.logins, sid)
+	}
+	return removed
+}
+
+// inUse reports whether a session still uses the client of user on host.
+func (l *loginRegistry) inUse(host, user string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire()
+	for _, hosts := range l.logins {
+		if e, ok := hosts[host]; ok && e.User == user {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the logins to host, most recently seen first.
+func (l *loginRegistry) list(host, sid string) []login {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire()
+	logins := make([]login, 0)
+	for s, hosts := range l.logins {
+		if e, ok := hosts[host]; ok {
+			c := *e
+			c.Current = s == sid
+			logins = append(logins, c)
+		}
+	}
+	sort.Slice(logins, func(i, j int) bool {
+		return logins[i].LastSeen > logins[j].LastSeen
+	})
+	return logins
+}
+
+// gc forgets the logins of expired sessions, it runs with the session GC.
+func (l *loginRegistry) gc() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire()
+}
+
+// expire forgets the logins of sessions idle longer than their lifetime.
+func (l *loginRegistry) expire() {
+	deadline := time.Now().Unix() - l.lifetime
+	for sid, hosts := range l.logins {
+		for h, e := range hosts {
+			if e.LastSeen <= deadline {
+				delete(hosts, h)
+			}
+		}
+		if len(hosts) == 0 {
+			delete(l.logins, sid)
+		}
+	}
+}
+
+func loginID(sid string) string {
+	sum := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString(sum[:8])
+}
+
+// release closes the client of user on host unless a session still uses it.
+func (h *v3Handlers) release(host, user string) {
+	if h.logins.inUse(host, user) {
+		return
+	}
+	olog.Debugf("release client of %s on %s", user, host)
+	h.climgr.RemoveClient(genCliKey(host, user))
+}
+
+// Logout logs the session out of host, the current host if none is given, or out
+// of all hosts and ends the session if all is set.
+func (h *v3Handlers) Logout(w http.ResponseWriter, r *http.Request) {
+	sess := h.sessmgr.SessionStart(w, r)
+	sid := sess.SessionID()
+	all := r.FormValue("all") == "true"
+
+	host := h.conf.Load().ClusterName(r.FormValue("host"))
+	cur, _ := sess.Get("host")
+	if host == "" && cur != nil {
+		host = cur.(string)
+	}
+
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method": r.Method,
+		"host":   host,
+		"all":    all,
+	})
+
+	var logouts []login
+	if all {
+		logouts = h.logins.remove(sid, "")
+		h.sessmgr.SessionDestroy(w, r)
+	} else {
+		if host == "" {
+			Rsp{"errorCode": 400, "message": "Not connected to any host."}.WriteTo(w)
+			return
+		}
+
+		logouts = h.logins.remove(sid, host)
+		if info, ok := sess.Get(host); ok && len(logouts) == 0 {
+			// logged in before a restart, the registry has not seen it yet
+			logouts = append(logouts, login{Host: host, User: info.(*userInfo).Name})
+		}
+		_ = sess.Delete(host)
+		_ = sess.Delete(draftSessionKey(host))
+		if cur == host {
+			_ = sess.Delete("host")
+		}
+	}
+
+	for _, e := range logouts {
+		h.release(e.Host, e.User)
+	}
+
+	logger.Infof("logged out of %d hosts", len(logouts))
+	Rsp{"status": "ok"}.WriteTo(w)
+}
+
+// Sessions lists the sessions logged in to the host of the user, only root or
+// users of clusters without auth may see them.
+func (h *v3Handlers) Sessions(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	if cli.Username != "" && cli.Username != "root" {
+		Rsp{"errorCode": 403, "message": "Only root can list sessions."}.WriteTo(w)
+		return
+	}
+
+	sess := h.sessmgr.SessionStart(w, r)
+	host, _ := sess.Get("host")
+	Rsp{"sessions": h.logins.list(host.(string), sess.SessionID())}.WriteTo(w)
+}
@@ -0,0 +1,185 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	policyDeny = "deny"
+	policyWarn = "warn"
+)
+
+// PolicyConf is a rule evaluated before writes under Prefix. When is an expression
+// of https://expr-lang.org, the rule applies if it evaluates to true.
+type PolicyConf struct {
+	Name   string `yaml:"name"`
+	Prefix string `yaml:"prefix"`
+	When   string `yaml:"when"`
+	// Action is deny or warn.
+	Action  string `yaml:"action"`
+	Message string `yaml:"message"`
+}
+
+type policy struct {
+	PolicyConf
+	program *vm.Program
+}
+
+// policyEnv is the environment policies are evaluated in.
+type policyEnv struct {
+	// Op is put or delete.
+	Op  string `expr:"op"`
+	Key string `expr:"key"`
+	// RangeEnd is set for deletes of a whole directory or range.
+	RangeEnd string `expr:"rangeEnd"`
+	Dir      bool   `expr:"dir"`
+	Value    string `expr:"value"`
+	OldValue string `expr:"oldValue"`
+	Exists   bool   `expr:"exists"`
+	Size     int    `expr:"size"`
+	User     string `expr:"user"`
+	// Children counts the keys under key, or in the range of a range delete.
+	Children func() int `expr:"children"`
+}
+
+// policyError is returned when a deny rule applies to a write.
+type policyError struct {
+	Policy  string
+	Message string
+}
+
+func (e *policyError) Error() string {
+	return e.Message
+}
+
+func compilePolicy(pc PolicyConf) (policy, error) {
+	if pc.Action != policyDeny && pc.Action != policyWarn {
+		return policy{}, fmt.Errorf("unknown action %q", pc.Action)
+	}
+
+	program, err := expr.Compile(pc.When, expr.Env(policyEnv{}), expr.AsBool())
+	if err != nil {
+		return policy{}, err
+	}
+
+	if pc.Message == "" {
+		pc.Message = "The write violates the policy " + pc.Name + "."
+	}
+	return policy{PolicyConf: pc, program: program}, nil
+}
+
+// policyCheck evaluates the policies of an etcd for the writes of a user.
+type policyCheck struct {
+	ctx  context.Context
+	cli  *clientv3.Client
+	cf   *Etcd
+	user string
+}
+
+func newPolicyCheck(r *http.Request, cli *clientv3.Client, cf *Etcd) *policyCheck {
+	return &policyCheck{ctx: r.Context(), cli: cli, cf: cf, user: identity(r, cli)}
+}
+
+// check evaluates the policies matching a write of key, or of the range [key, end)
+// if end is not empty. It returns the messages of warn rules that apply, and a
+// *policyError if a deny rule applies.
+func (c *policyCheck) check(op, key, end, value string) ([]string, error) {
+	var matched []*policy
+	for i := range c.cf.policies {
+		p := &c.cf.policies[i]
+		if end == "" && strings.HasPrefix(key, p.Prefix) || end != "" && rangeOverlapsPrefix(key, end, p.Prefix) {
+			matched = append(matched, p)
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	env := policyEnv{
+		Op:       op,
+		Key:      key,
+		RangeEnd: end,
+		Dir:      end != "",
+		Value:    value,
+		Size:     len(value),
+		User:     c.user,
+	}
+
+	if key != "" {
+		getRsp, err := c.cli.Get(c.ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(getRsp.Kvs) > 0 {
+			env.Exists = true
+			env.OldValue = c.cf.decodeStored(key, getRsp.Kvs[0].Value)
+		}
+	}
+
+	children := -1
+	var childrenErr error
+	env.Children = func() int {
+		if children < 0 {
+			children, childrenErr = c.countChildren(key, end)
+		}
+		return children
+	}
+
+	var warnings []string
+	for _, p := range matched {
+		out, err := expr.Run(p.program, env)
+		if childrenErr != nil {
+			return nil, childrenErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("evaluate policy %s: %w", p.Name, err)
+		}
+		if ok, _ := out.(bool); !ok {
+			continue
+		}
+
+		if p.Action == policyDeny {
+			return nil, &policyError{Policy: p.Name, Message: p.Message}
+		}
+		warnings = append(warnings, p.Message)
+	}
+	return warnings, nil
+}
+
+func (c *policyCheck) countChildren(key, end string) (int, error) {
+	var opts []clientv3.OpOption
+	if end != "" {
+		if key == "" {
+			key = "\x00"
+		}
+		opts = append(opts, clientv3.WithRange(end))
+	} else {
+		key += c.cf.Separator
+		opts = append(opts, clientv3.WithPrefix())
+	}
+
+	getRsp, err := c.cli.Get(c.ctx, key, append(opts, clientv3.WithCountOnly())...)
+	if err != nil {
+		return 0, err
+	}
+	return int(getRsp.Count), nil
+}
+
+// writePolicyErr writes err, denials are answered with 403.
+func writePolicyErr(w http.ResponseWriter, err error) {
+	var pe *policyError
+	if errors.As(err, &pe) {
+		Rsp{"errorCode": 403, "message": pe.Message, "policy": pe.Policy}.WriteTo(w)
+		return
+	}
+	Rsp{"errorCode": 500, "message": "check policies failed: " + err.Error()}.WriteTo(w)
+}
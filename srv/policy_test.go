@@ -0,0 +1,89 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	cf := Etcd{Separator: "/", Policies: []PolicyConf{
+		{Name: "size", Prefix: "/app/", When: `op == "put" && size > 3`, Action: policyDeny, Message: "too large"},
+		{Name: "new", Prefix: "/app/", When: `op == "put" && !exists`, Action: policyWarn, Message: "new key"},
+		{Name: "changed", Prefix: "/app/", When: `exists && oldValue == "v"`, Action: policyWarn, Message: "changes v"},
+		{Name: "big dir", Prefix: "/app/", When: `dir && children() > 2`, Action: policyDeny, Message: "big dir"},
+		{Name: "prod", Prefix: "/prod/", When: `user != "admin"`, Action: policyDeny},
+	}}
+	if err := cf.init(); err != nil {
+		t.Fatal(err)
+	}
+	cli, _ := newFakeClient("/app/a", "/app/d/1", "/app/d/2", "/app/d/3", "/app/e/1", "/other/x")
+
+	tests := []struct {
+		name     string
+		user     string
+		op       string
+		key      string
+		end      string
+		value    string
+		warnings []string
+		denied   string
+	}{
+		{name: "no policy", op: opPut, key: "/other/x", value: "large value"},
+		{name: "new key", op: opPut, key: "/app/b", value: "1", warnings: []string{"new key"}},
+		{name: "existing key", op: opPut, key: "/app/a", value: "1", warnings: []string{"changes v"}},
+		{name: "deny", op: opPut, key: "/app/b", value: "1234", denied: "size"},
+		{name: "delete", op: opDelete, key: "/app/a", warnings: []string{"changes v"}},
+		{name: "small dir", op: opDelete, key: "/app/e/", end: clientv3.GetPrefixRangeEnd("/app/e/")},
+		{name: "big dir", op: opDelete, key: "/app/d/", end: clientv3.GetPrefixRangeEnd("/app/d/"), denied: "big dir"},
+		{name: "range overlaps prefix", op: opDelete, key: "/", end: "0", denied: "big dir"},
+		{name: "user", user: "alice", op: opPut, key: "/prod/x", value: "1", denied: "prod"},
+		{name: "admin", user: "admin", op: opPut, key: "/prod/x", value: "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := &policyCheck{ctx: context.Background(), cli: cli, cf: &cf, user: tt.user}
+			warnings, err := pc.check(tt.op, tt.key, tt.end, tt.value)
+			if tt.denied != "" {
+				var pe *policyError
+				if !errors.As(err, &pe) || pe.Policy != tt.denied {
+					t.Fatalf("err = %v, want denied by %s", err, tt.denied)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(warnings, tt.warnings) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestCompilePolicy(t *testing.T) {
+	tests := []struct {
+		pc      PolicyConf
+		invalid bool
+	}{
+		{pc: PolicyConf{Name: "ok", When: "size > 10", Action: policyWarn}},
+		{pc: PolicyConf{Name: "action", When: "size > 10", Action: "block"}, invalid: true},
+		{pc: PolicyConf{Name: "syntax", When: "size >", Action: policyDeny}, invalid: true},
+		{pc: PolicyConf{Name: "unknown variable", When: "length > 10", Action: policyDeny}, invalid: true},
+		{pc: PolicyConf{Name: "not bool", When: "size + 1", Action: policyDeny}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		p, err := compilePolicy(tt.pc)
+		if (err != nil) != tt.invalid {
+			t.Errorf("%s: err = %v, want invalid %v", tt.pc.Name, err, tt.invalid)
+		}
+		if err == nil && p.Message == "" {
+			t.Errorf("%s: no default message", tt.pc.Name)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package srv
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/welllog/olog"
+	"gopkg.in/yaml.v3"
+)
+
+// confCheckInterval is how often the config file is checked for changes.
+const confCheckInterval = 2 * time.Second
+
+// fileVersion tells versions of a file apart by their modification time and size.
+type fileVersion struct {
+	mod  int64
+	size int64
+}
+
+func statFileVersion(file string) (fileVersion, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{mod: fi.ModTime().UnixNano(), size: fi.Size()}, nil
+}
+
+// WatchConfig reloads the config from file when the file changes or the process
+// receives SIGHUP, once the server is started.
+func (s *Server) WatchConfig(file string) {
+	s.confFile = file
+}
+
+// watchConfig starts watching the config file, the returned func stops it.
+func (s *Server) watchConfig() func() {
+	if s.confFile == "" {
+		return func() {}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(confCheckInterval)
+		defer ticker.Stop()
+
+		last, _ := statFileVersion(s.confFile)
+		for {
+			select {
+			case <-ticker.C:
+				v, err := statFileVersion(s.confFile)
+				// the file may be missing for a moment while an editor replaces it
+				if err != nil || v == last {
+					continue
+				}
+				last = v
+				olog.Infof("%s changed, reload it", s.confFile)
+			case <-hup:
+				last, _ = statFileVersion(s.confFile)
+				olog.Infof("SIGHUP received, reload %s", s.confFile)
+			case <-done:
+				return
+			}
+
+			if err := s.reloadFile(); err != nil {
+				olog.Errorf("reload %s failed, keep the current config: %v", s.confFile, err)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hup)
+		close(done)
+		<-stopped
+	}
+}
+
+func (s *Server) reloadFile() error {
+	b, err := os.ReadFile(s.confFile)
+	if err != nil {
+		return err
+	}
+
+	var cf Conf
+	if err = yaml.Unmarshal(b, &cf); err != nil {
+		return err
+	}
+	if err = cf.Init(); err != nil {
+		return err
+	}
+	return s.reload(cf)
+}
+
+// reload applies cf to the running server. Nothing is applied if a part of it
+// fails, settings that need a restart keep their current values.
+func (s *Server) reload(cf Conf) error {
+	old := s.v3.conf.Load()
+	if changed := keepRestartSettings(old, &cf); len(changed) > 0 {
+		olog.Warnf("%s changed, restart to apply", strings.Join(changed, ", "))
+	}
+
+	// certificate and CA files are read again even if their paths did not change
+	var tlsConfig *tls.Config
+	if cf.Tls.Enable {
+		var err error
+		tlsConfig, err = newServerTLSConfig(cf.Tls)
+		if err != nil {
+			return err
+		}
+	}
+
+	var hooks *webhookDispatcher
+	if webhooksChanged(old, &cf) {
+		hooks = newWebhookDispatcher(cf)
+	}
+
+	if cf.Loglevel != old.Loglevel {
+		olog.Infof("log level %s", cf.Loglevel)
+	}
+	olog.SetLevel(olog.GetLevelByString(cf.Loglevel))
+
+	if tlsConfig != nil {
+		s.tls.Store(tlsConfig)
+	}
+
+	// clients connected from now on use the new config, the old ones are closed
+	s.v3.conf.Store(&cf)
+	for _, e := range old.Etcds {
+		n, ok := cf.etcds[e.Name]
+		if ok && !connectionChanged(e, n) {
+			continue
+		}
+
+		closed := s.clients.RemoveClients(func(key string) bool {
+			return strings.HasPrefix(key, cliKeyPrefix(e.Name))
+		})
+		if ok {
+			olog.Infof("etcd %s changed, %d clients closed", e.Name, closed)
+		} else {
+			olog.Infof("etcd %s removed, %d clients closed", e.Name, closed)
+		}
+	}
+	for _, e := range cf.Etcds {
+		if _, ok := old.etcds[e.Name]; !ok {
+			olog.Infof("etcd %s added", e.Name)
+		}
+	}
+
+	if hooks != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		s.mu.Lock()
+		s.hooks.Stop(ctx)
+		hooks.resumeFrom(s.hooks)
+		hooks.Start()
+		s.hooks = hooks
+		s.mu.Unlock()
+	}
+
+	olog.Infof("config reloaded, %d etcds", len(cf.Etcds))
+	return nil
+}
+
+// keepRestartSettings sets the settings of cf that can not change while running
+// back to those of old, it returns the names of those that differed.
+func keepRestartSettings(old, cf *Conf) []string {
+	var changed []string
+	if cf.Host != old.Host || cf.Port != old.Port {
+		changed = append(changed, "host:port")
+		cf.Host, cf.Port = old.Host, old.Port
+	}
+	if cf.Debug != old.Debug {
+		changed = append(changed, "debug")
+		cf.Debug = old.Debug
+	}
+	if cf.Tls.Enable != old.Tls.Enable {
+		changed = append(changed, "tls.enable")
+		cf.Tls = old.Tls
+	}
+	if !reflect.DeepEqual(cf.Session, old.Session) {
+		changed = append(changed, "session")
+		cf.Session = old.Session
+	}
+	if cf.MaxClients != old.MaxClients {
+		changed = append(changed, "maxClients")
+		cf.MaxClients = old.MaxClients
+	}
+	if cf.HealthCheckInterval != old.HealthCheckInterval {
+		changed = append(changed, "healthCheckInterval")
+		cf.HealthCheckInterval = old.HealthCheckInterval
+	}
+	return changed
+}
+
+// connectionChanged reports whether clients of a connected with the settings of a
+// must be replaced to use those of b, also when the TLS files were replaced under
+// the same paths.
+func connectionChanged(a, b Etcd) bool {
+	return !slices.Equal(a.Endpoints, b.Endpoints) || a.AutoSyncInterval != b.AutoSyncInterval ||
+		a.Tls != b.Tls || a.tlsFiles != b.tlsFiles
+}
+
+// webhooksChanged reports whether the webhook dispatcher of old must be replaced
+// to deliver the webhooks of cf.
+func webhooksChanged(old, cf *Conf) bool {
+	if old.WebhookDeadLetter != cf.WebhookDeadLetter {
+		return true
+	}
+
+	withHooks := func(c *Conf) map[string]Etcd {
+		m := make(map[string]Etcd)
+		for _, e := range c.Etcds {
+			if len(e.Webhooks) > 0 {
+				m[e.Name] = e
+			}
+		}
+		return m
+	}
+
+	a, b := withHooks(old), withHooks(cf)
+	if len(a) != len(b) {
+		return true
+	}
+	for name, e := range a {
+		n, ok := b[name]
+		// events are decoded with the codecs of the cluster
+		if !ok || connectionChanged(e, n) || !reflect.DeepEqual(e.Webhooks, n.Webhooks) ||
+			!reflect.DeepEqual(e.Codecs, n.Codecs) {
+			return true
+		}
+	}
+	return false
+}
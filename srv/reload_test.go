@@ -0,0 +1,54 @@
+package srv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConnectionChanged(t *testing.T) {
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, []byte("ca"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(change func(*Etcd)) Etcd {
+		t.Helper()
+		e := Etcd{Name: "default", Endpoints: Endpoints{"127.0.0.1:2379"}}
+		e.Tls.Enable = true
+		e.Tls.TrustedCAFile = ca
+		if change != nil {
+			change(&e)
+		}
+		if err := e.init(); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	old := load(nil)
+
+	tests := []struct {
+		name   string
+		change func(*Etcd)
+		want   bool
+	}{
+		{name: "unchanged"},
+		{name: "separator", change: func(e *Etcd) { e.Separator = "." }},
+		{name: "endpoints", change: func(e *Etcd) { e.Endpoints = Endpoints{"127.0.0.1:22379"} }, want: true},
+		{name: "auto sync", change: func(e *Etcd) { e.AutoSyncInterval = 60 }, want: true},
+		{name: "tls path", change: func(e *Etcd) { e.Tls.TrustedCAFile = ca + ".new" }, want: true},
+	}
+	for _, tt := range tests {
+		if got := connectionChanged(old, load(tt.change)); got != tt.want {
+			t.Errorf("%s: changed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// a certificate replaced under the same path is read again
+	if err := os.WriteFile(ca, []byte("new ca"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !connectionChanged(old, load(nil)) {
+		t.Error("replaced CA file not detected")
+	}
+}
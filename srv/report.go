@@ -0,0 +1,193 @@
+package srv
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/welllog/olog"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+const (
+	reportDefaultTop = 10
+	reportMaxTop     = 100
+)
+
+type reportKey struct {
+	Key     string `json:"key"`
+	Size    int64  `json:"size"`
+	Version int64  `json:"version"`
+	Lease   string `json:"lease,omitempty"`
+}
+
+type reportStat struct {
+	Dir        string `json:"dir,omitempty"`
+	Keys       int64  `json:"keys"`
+	KeyBytes   int64  `json:"keyBytes"`
+	ValueBytes int64  `json:"valueBytes"`
+	ValueSize  string `json:"valueSize"`
+	Leased     int64  `json:"leased"`
+}
+
+func (s *reportStat) add(kv *mvccpb.KeyValue) {
+	s.Keys++
+	s.KeyBytes += int64(len(kv.Key))
+	s.ValueBytes += int64(len(kv.Value))
+	if kv.Lease != 0 {
+		s.Leased++
+	}
+}
+
+// topKeys keeps the n greatest keys by cmp in descending order.
+type topKeys struct {
+	n    int
+	cmp  func(a, b reportKey) int
+	keys []reportKey
+}
+
+func (t *topKeys) add(k reportKey) {
+	if len(t.keys) == t.n && t.cmp(k, t.keys[len(t.keys)-1]) <= 0 {
+		return
+	}
+
+	i, _ := slices.BinarySearchFunc(t.keys, k, func(a, b reportKey) int {
+		return t.cmp(b, a)
+	})
+	t.keys = slices.Insert(t.keys, i, k)
+	if len(t.keys) > t.n {
+		t.keys = t.keys[:t.n]
+	}
+}
+
+// Report walks the keys under a prefix and aggregates counts and sizes per
+// directory at the given depth, together with the largest keys, the keys
+// with most versions and the keys attached to leases.
+func (h *v3Handlers) Report(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	key := r.FormValue("key")
+
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method": r.Method,
+		"host":   cli.Host,
+		"uname":  cli.Username,
+		"key":    key,
+	})
+
+	logger.Debug("REPORT v3")
+
+	depth := 1
+	if s := r.FormValue("depth"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			Rsp{"errorCode": 400, "message": "invalid depth: " + s}.WriteTo(w)
+			return
+		}
+		depth = n
+	}
+
+	top := reportDefaultTop
+	if s := r.FormValue("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			Rsp{"errorCode": 400, "message": "invalid top: " + s}.WriteTo(w)
+			return
+		}
+		top = min(n, reportMaxTop)
+	}
+
+	cf, ok := h.conf.Load().GetEtcdConfig(cli.Host)
+	if !ok {
+		cf.Separator = "/"
+	}
+
+	ctx := r.Context()
+	ranges, err := readableRanges(ctx, cli.Client, key)
+	if err != nil {
+		logger.Warnf("get permission keys failed: %v", err)
+		Rsp{"errorCode": 500, "message": "get permission keys failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	var total reportStat
+	dirs := make(map[string]*reportStat)
+	largest := topKeys{n: top, cmp: func(a, b reportKey) int {
+		return cmp.Compare(a.Size, b.Size)
+	}}
+	versions := topKeys{n: top, cmp: func(a, b reportKey) int {
+		return cmp.Compare(a.Version, b.Version)
+	}}
+	leased := topKeys{n: top, cmp: func(a, b reportKey) int {
+		return cmp.Compare(a.Size, b.Size)
+	}}
+
+	_, err = scanRanges(ctx, cli.Client, ranges, "", func(kv *mvccpb.KeyValue) bool {
+		total.add(kv)
+
+		dir := reportDir(string(kv.Key), key, cf.Separator, depth)
+		st, ok := dirs[dir]
+		if !ok {
+			st = &reportStat{Dir: dir}
+			dirs[dir] = st
+		}
+		st.add(kv)
+
+		rk := reportKey{Key: string(kv.Key), Size: int64(len(kv.Value)), Version: kv.Version}
+		if kv.Lease != 0 {
+			rk.Lease = strconv.FormatInt(kv.Lease, 16)
+			leased.add(rk)
+		}
+		largest.add(rk)
+		versions.add(rk)
+		return true
+	})
+	if err != nil {
+		logger.Warnf("scan failed: %v", err)
+		Rsp{"errorCode": 500, "message": "scan failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	list := make([]*reportStat, 0, len(dirs))
+	for _, st := range dirs {
+		st.ValueSize = sizeFormat(st.ValueBytes)
+		list = append(list, st)
+	}
+	slices.SortFunc(list, func(a, b *reportStat) int {
+		if c := cmp.Compare(b.ValueBytes, a.ValueBytes); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Dir, b.Dir)
+	})
+	total.ValueSize = sizeFormat(total.ValueBytes)
+
+	Rsp{
+		"prefix":       key,
+		"depth":        depth,
+		"total":        total,
+		"dirs":         list,
+		"largest":      largest.keys,
+		"mostVersions": versions.keys,
+		"leased":       leased.keys,
+	}.WriteTo(w)
+}
+
+// reportDir returns the directory of key at depth levels below prefix,
+// or the parent directory of key if it is not as deep.
+func reportDir(key, prefix, separator string, depth int) string {
+	end := len(prefix)
+	for i := 0; i < depth; i++ {
+		offset := strings.Index(key[end:], separator)
+		if offset < 0 {
+			break
+		}
+		end += offset + len(separator)
+	}
+	return key[:end]
+}
@@ -0,0 +1,276 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/welllog/olog"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// restorePreviewLimit limits the changes listed by a dry run.
+	restorePreviewLimit = 1000
+	// maxRestoreOps keeps a restore in one transaction, which also compares the
+	// range was not written after base.
+	maxRestoreOps = maxTxnOps - 1
+)
+
+// restoreChange is a write needed to bring a key back to its value at a past revision.
+type restoreChange struct {
+	Key string `json:"key"`
+	// Op is put for keys that changed or were deleted since, delete for keys created since.
+	Op       string `json:"op"`
+	Value    string `json:"value,omitempty"`
+	OldValue string `json:"oldValue,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+
+	value []byte
+	// modRevision of the key at the base revision, 0 if it did not exist.
+	modRevision int64
+}
+
+// Restore writes key, or every key under it if dir is set, back to its value at
+// rev and deletes keys created since. Unless apply is set it only lists the
+// changes, with the base revision to apply them at.
+func (h *v3Handlers) Restore(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	key := r.FormValue("key")
+	dir := r.FormValue("dir") == "true"
+	apply := r.FormValue("apply") == "true"
+
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method": r.Method,
+		"host":   cli.Host,
+		"uname":  cli.Username,
+		"key":    key,
+	})
+
+	logger.Debug("RESTORE v3")
+
+	rev, err := strconv.ParseInt(r.FormValue("rev"), 10, 64)
+	if err != nil || rev <= 0 {
+		Rsp{"errorCode": 400, "message": "invalid rev: " + r.FormValue("rev")}.WriteTo(w)
+		return
+	}
+
+	var base int64
+	if v := r.FormValue("base"); v != "" {
+		base, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			Rsp{"errorCode": 400, "message": "invalid base: " + v}.WriteTo(w)
+			return
+		}
+	}
+
+	kr := keyRange{from: key, end: key + "\x00"}
+	if dir {
+		kr.end = clientv3.GetPrefixRangeEnd(key)
+	}
+
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	if cf.OverlapsProtected(kr.from, kr.end) {
+		Rsp{"errorCode": 403, "message": "Protected keys can not be restored, they must be changed through approval."}.WriteTo(w)
+		return
+	}
+	if cf.Trash.touches(kr.from, kr.end) {
+		Rsp{"errorCode": 403, "message": "Keys of the trash can not be restored."}.WriteTo(w)
+		return
+	}
+
+	ctx := r.Context()
+	if base == 0 {
+		rsp, err := cli.Get(ctx, key, clientv3.WithCountOnly())
+		if err != nil {
+			Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+			return
+		}
+		base = rsp.Header.Revision
+	}
+	if rev > base {
+		Rsp{"errorCode": 400, "message": "The revision is newer than the current one."}.WriteTo(w)
+		return
+	}
+
+	past, err := readKvs(ctx, cli.Client, kr, rev)
+	if err != nil {
+		logger.Warnf("read revision %d failed: %v", rev, err)
+		Rsp{"errorCode": 500, "message": "read revision failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	cur, err := readKvs(ctx, cli.Client, kr, base)
+	if err != nil {
+		logger.Warnf("read revision %d failed: %v", base, err)
+		Rsp{"errorCode": 500, "message": "read revision failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	changes := diffRestore(&cf, past, cur)
+	if !apply {
+		Rsp{
+			"status":   "preview",
+			"revision": rev,
+			"base":     base,
+			"total":    len(changes),
+			"changes":  changes[:min(len(changes), restorePreviewLimit)],
+		}.WriteTo(w)
+		return
+	}
+	if len(changes) > maxRestoreOps {
+		Rsp{"errorCode": 400, "message": fmt.Sprintf("The restore changes %d keys, at most %d can be restored at once, restore the directories under it one by one.", len(changes), maxRestoreOps)}.WriteTo(w)
+		return
+	}
+
+	// etcd can not compare the number of keys in a transaction, so keys deleted
+	// since base are found by counting them before the changes are applied
+	countRsp, err := cli.Get(ctx, keyOrMin(kr.from), clientv3.WithRange(kr.end), clientv3.WithCountOnly())
+	if err != nil {
+		Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+	if countRsp.Count != int64(len(cur)) {
+		Rsp{"errorCode": 409, "message": "Keys were changed after the restore was previewed, please try again."}.WriteTo(w)
+		return
+	}
+
+	pc := newPolicyCheck(r, cli.Client, &cf)
+	var warnings []string
+	ops := make([]clientv3.Op, len(changes))
+	// no key of the range was written after base, and each key is still as it
+	// was at base, which also catches the keys deleted since
+	guards := []clientv3.Cmp{unchangedSince(key, dir, base)}
+	for i, c := range changes {
+		if c.modRevision > 0 {
+			guards = append(guards, clientv3.Compare(clientv3.ModRevision(c.Key), "=", c.modRevision))
+		} else {
+			guards = append(guards, clientv3.Compare(clientv3.CreateRevision(c.Key), "=", 0))
+		}
+
+		var value string
+		if c.Op == opPut {
+			// restored values are checked like any other write
+			_, ws, err := cf.checkValue(c.Key, string(c.value), "", "false", true)
+			if err != nil {
+				Rsp{"errorCode": 422, "message": c.Key + ": " + err.Error()}.WriteTo(w)
+				return
+			}
+			warnings = append(warnings, ws...)
+
+			value = cf.decodeStored(c.Key, c.value)
+			ops[i] = clientv3.OpPut(c.Key, string(c.value))
+		} else {
+			ops[i] = clientv3.OpDelete(c.Key)
+		}
+
+		ws, err := pc.check(c.Op, c.Key, "", value)
+		if err != nil {
+			logger.Infof("policy check of %s: %v", c.Key, err)
+			writePolicyErr(w, err)
+			return
+		}
+		warnings = append(warnings, ws...)
+	}
+
+	revision := base
+	if len(ops) > 0 {
+		txnRsp, err := cli.Txn(ctx).If(guards...).Then(ops...).Commit()
+		if err != nil {
+			logger.Warnf("restore failed: %v", err)
+			Rsp{"errorCode": 500, "message": "restore failed: " + err.Error()}.WriteTo(w)
+			return
+		}
+		if !txnRsp.Succeeded {
+			Rsp{"errorCode": 409, "message": "Keys were changed after the restore was previewed, please try again."}.WriteTo(w)
+			return
+		}
+		revision = txnRsp.Header.Revision
+	}
+	logger.Infof("restored %d keys to revision %d at revision %d", len(changes), rev, revision)
+	rsp := Rsp{"status": "ok", "total": len(changes), "revision": revision}
+	if len(warnings) > 0 {
+		rsp["warnings"] = warnings
+	}
+	rsp.WriteTo(w)
+}
+
+// keyOrMin returns key, or "\x00" if key is empty, etcd rejects empty keys and
+// "\x00" is the smallest valid one.
+func keyOrMin(key string) string {
+	if key == "" {
+		return "\x00"
+	}
+	return key
+}
+
+// readKvs reads the keys of kr at rev.
+func readKvs(ctx context.Context, cli *clientv3.Client, kr keyRange, rev int64) ([]*mvccpb.KeyValue, error) {
+	var kvs []*mvccpb.KeyValue
+	_, err := scanRanges(ctx, cli, []keyRange{kr}, "", func(kv *mvccpb.KeyValue) bool {
+		kvs = append(kvs, kv)
+		return true
+	}, clientv3.WithRev(rev))
+	return kvs, err
+}
+
+// diffRestore lists the changes turning cur into past, both sorted by key.
+func diffRestore(cf *Etcd, past, cur []*mvccpb.KeyValue) []restoreChange {
+	changes := make([]restoreChange, 0)
+	i, j := 0, 0
+	for i < len(past) || j < len(cur) {
+		var c int
+		switch {
+		case i == len(past):
+			c = 1
+		case j == len(cur):
+			c = -1
+		default:
+			c = bytes.Compare(past[i].Key, cur[j].Key)
+		}
+
+		switch {
+		case c < 0:
+			changes = append(changes, newRestoreChange(cf, opPut, past[i].Key, past[i].Value, nil))
+			i++
+		case c > 0:
+			change := newRestoreChange(cf, opDelete, cur[j].Key, nil, cur[j].Value)
+			change.modRevision = cur[j].ModRevision
+			changes = append(changes, change)
+			j++
+		default:
+			if !bytes.Equal(past[i].Value, cur[j].Value) {
+				change := newRestoreChange(cf, opPut, past[i].Key, past[i].Value, cur[j].Value)
+				change.modRevision = cur[j].ModRevision
+				changes = append(changes, change)
+			}
+			i++
+			j++
+		}
+	}
+	return changes
+}
+
+func newRestoreChange(cf *Etcd, op string, key, value, oldValue []byte) restoreChange {
+	c := restoreChange{Key: string(key), Op: op, value: value}
+	v := []byte(cf.decodeStored(c.Key, value))
+	ov := []byte(cf.decodeStored(c.Key, oldValue))
+	if utf8.Valid(v) && utf8.Valid(ov) {
+		c.Value, c.OldValue = string(v), string(ov)
+	} else {
+		c.Value = base64.StdEncoding.EncodeToString(v)
+		c.OldValue = base64.StdEncoding.EncodeToString(ov)
+		c.Encoding = encodingBase64
+	}
+	return c
+}
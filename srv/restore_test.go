@@ -0,0 +1,88 @@
+package srv
+
+import (
+	"slices"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestDiffRestore(t *testing.T) {
+	kvs := func(pairs ...string) []*mvccpb.KeyValue {
+		var kvs []*mvccpb.KeyValue
+		for i := 0; i < len(pairs); i += 2 {
+			kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(pairs[i]), Value: []byte(pairs[i+1]), ModRevision: int64(10 + i)})
+		}
+		return kvs
+	}
+
+	tests := []struct {
+		name    string
+		past    []*mvccpb.KeyValue
+		cur     []*mvccpb.KeyValue
+		puts    []string
+		deletes []string
+	}{
+		{name: "unchanged", past: kvs("/a", "1", "/b", "2"), cur: kvs("/a", "1", "/b", "2")},
+		{name: "changed", past: kvs("/a", "1", "/b", "2"), cur: kvs("/a", "1", "/b", "3"), puts: []string{"/b"}},
+		{name: "deleted since", past: kvs("/a", "1", "/b", "2", "/c", "3"), cur: kvs("/b", "2"), puts: []string{"/a", "/c"}},
+		{name: "created since", past: kvs("/b", "2"), cur: kvs("/a", "1", "/b", "2", "/c", "3"), deletes: []string{"/a", "/c"}},
+		{name: "all new", cur: kvs("/a", "1"), deletes: []string{"/a"}},
+		{name: "all gone", past: kvs("/a", "1"), puts: []string{"/a"}},
+		{
+			name:    "mixed",
+			past:    kvs("/a", "1", "/c", "3", "/d", "4"),
+			cur:     kvs("/b", "2", "/c", "x", "/d", "4", "/e", "5"),
+			puts:    []string{"/a", "/c"},
+			deletes: []string{"/b", "/e"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var puts, deletes []string
+			revs := make(map[string]int64)
+			for _, kv := range tt.cur {
+				revs[string(kv.Key)] = kv.ModRevision
+			}
+			for _, c := range diffRestore(&Etcd{}, tt.past, tt.cur) {
+				if c.Op == opPut {
+					puts = append(puts, c.Key)
+				} else {
+					deletes = append(deletes, c.Key)
+				}
+				// the guard of a change is the current revision of its key
+				if c.modRevision != revs[c.Key] {
+					t.Errorf("%s: modRevision = %d, want %d", c.Key, c.modRevision, revs[c.Key])
+				}
+			}
+			if !slices.Equal(puts, tt.puts) || !slices.Equal(deletes, tt.deletes) {
+				t.Errorf("puts = %q, deletes = %q, want %q and %q", puts, deletes, tt.puts, tt.deletes)
+			}
+		})
+	}
+}
+
+func TestRangeOverlapsPrefix(t *testing.T) {
+	tests := []struct {
+		from, end, prefix string
+		want              bool
+	}{
+		{from: "/app/", end: "/app0", prefix: "/app/", want: true},
+		{from: "/app/a", end: "/app/a\x00", prefix: "/app/", want: true},
+		{from: "/", end: "0", prefix: "/app/", want: true},
+		{from: "/app/x/", end: "/app/x0", prefix: "/app/", want: true},
+		{from: "/b", end: "/c", prefix: "/app/"},
+		{from: "/a", end: "/app/", prefix: "/app/"},
+		{from: "/app0", end: "\x00", prefix: "/app/"},
+		{from: "/", end: "\x00", prefix: "/app/", want: true},
+		{from: "\x00", end: "\x00", prefix: "", want: true},
+		{from: "/app", end: "/app\x00", prefix: "/app/"},
+	}
+
+	for _, tt := range tests {
+		if got := rangeOverlapsPrefix(tt.from, tt.end, tt.prefix); got != tt.want {
+			t.Errorf("rangeOverlapsPrefix(%q, %q, %q) = %v, want %v", tt.from, tt.end, tt.prefix, got, tt.want)
+		}
+	}
+}
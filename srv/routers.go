@@ -5,9 +5,27 @@ import "net/http"
 func bindV3Router(mux *http.ServeMux, v3 *v3Handlers) {
 	mux.HandleFunc("GET /hosts", v3.Hosts)
 	mux.HandleFunc("POST /v3/connect", v3.Connect)
+	mux.HandleFunc("POST /v3/logout", v3.Logout)
+	mux.HandleFunc("GET /v3/sessions", v3.Sessions)
 	mux.HandleFunc("PUT /v3/put", v3.Put)
 	mux.HandleFunc("GET /v3/get", v3.Get)
 	mux.HandleFunc("POST /v3/delete", v3.Del)
 	mux.HandleFunc("GET /v3/getpath", v3.GetPath)
 	mux.HandleFunc("GET /v3/history", v3.History)
+	mux.HandleFunc("GET /v3/proposals", v3.Proposals)
+	mux.HandleFunc("POST /v3/proposal/approve", v3.ApproveProposal)
+	mux.HandleFunc("POST /v3/proposal/reject", v3.RejectProposal)
+	mux.HandleFunc("GET /v3/draft", v3.Draft)
+	mux.HandleFunc("POST /v3/draft/put", v3.DraftPut)
+	mux.HandleFunc("POST /v3/draft/delete", v3.DraftDel)
+	mux.HandleFunc("POST /v3/draft/unstage", v3.DraftUnstage)
+	mux.HandleFunc("POST /v3/draft/discard", v3.DraftDiscard)
+	mux.HandleFunc("POST /v3/draft/commit", v3.DraftCommit)
+	mux.HandleFunc("POST /v3/txn", v3.Txn)
+	mux.HandleFunc("GET /v3/search", v3.Search)
+	mux.HandleFunc("GET /v3/report", v3.Report)
+	mux.HandleFunc("GET /v3/trash", v3.Trash)
+	mux.HandleFunc("POST /v3/trash/restore", v3.RestoreTrash)
+	mux.HandleFunc("POST /v3/trash/purge", v3.PurgeTrash)
+	mux.HandleFunc("POST /v3/restore", v3.Restore)
 }
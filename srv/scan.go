@@ -0,0 +1,104 @@
+package srv
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const scanPageSize = 500
+
+// readableRanges returns the key ranges under prefix that the client is allowed to read.
+// Root and users of clusters without auth read the whole prefix, other users only the
+// ranges granted by their roles.
+func readableRanges(ctx context.Context, cli *clientv3.Client, prefix string) ([]keyRange, error) {
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	if cli.Username == "" || cli.Username == "root" {
+		return []keyRange{{from: prefix, end: end}}, nil
+	}
+
+	perms, err := getPermissionKeys(ctx, cli)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := make([]keyRange, 0, len(perms))
+	for _, kr := range perms {
+		if kr.end == "" {
+			// single key permission
+			if strings.HasPrefix(kr.from, prefix) {
+				ranges = append(ranges, keyRange{from: kr.from, end: kr.from + "\x00"})
+			}
+			continue
+		}
+
+		r := keyRange{from: max(kr.from, prefix), end: kr.end}
+		if rangeEndLess(end, r.end) {
+			r.end = end
+		}
+		if r.end == "\x00" || r.from < r.end {
+			ranges = append(ranges, r)
+		}
+	}
+
+	slices.SortFunc(ranges, func(a, b keyRange) int {
+		return strings.Compare(a.from, b.from)
+	})
+	return ranges, nil
+}
+
+// rangeEndLess compares two range ends where "\x00" means no upper bound.
+func rangeEndLess(a, b string) bool {
+	if a == "\x00" {
+		return false
+	}
+	return b == "\x00" || a < b
+}
+
+// scanRanges walks the ranges page by page in key order starting at the key from,
+// pinning every page to the revision of the first one. fn returns false to stop
+// the scan after kv, in which case the key to continue from is returned.
+func scanRanges(ctx context.Context, cli *clientv3.Client, ranges []keyRange, from string,
+	fn func(kv *mvccpb.KeyValue) bool, opts ...clientv3.OpOption) (string, error) {
+	var rev int64
+	for _, kr := range ranges {
+		if from != "" && !rangeEndLess(from, kr.end) {
+			continue
+		}
+
+		start := max(kr.from, from)
+		if start == "" {
+			// etcd rejects an empty key, "\x00" is the smallest valid one
+			start = "\x00"
+		}
+		for {
+			pageOpts := append([]clientv3.OpOption{
+				clientv3.WithRange(kr.end),
+				clientv3.WithLimit(scanPageSize),
+				clientv3.WithRev(rev),
+			}, opts...)
+
+			rsp, err := cli.Get(ctx, start, pageOpts...)
+			if err != nil {
+				return "", err
+			}
+			rev = rsp.Header.Revision
+
+			for _, kv := range rsp.Kvs {
+				if !fn(kv) {
+					return string(kv.Key) + "\x00", nil
+				}
+			}
+
+			if !rsp.More || len(rsp.Kvs) == 0 {
+				break
+			}
+			start = string(rsp.Kvs[len(rsp.Kvs)-1].Key) + "\x00"
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,162 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+)
+
+type SchemaConf struct {
+	Prefix string `yaml:"prefix"`
+	// File is a JSON Schema in JSON or YAML format.
+	File string `yaml:"file"`
+}
+
+type prefixSchema struct {
+	prefix string
+	schema *jsonschema.Schema
+}
+
+// fieldError is a validation failure at a JSON pointer of the value.
+type fieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// validationError is returned when a value is rejected, it carries the
+// failures of every field.
+type validationError struct {
+	msg    string
+	Fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	if len(e.Fields) == 0 {
+		return e.msg
+	}
+
+	var sb strings.Builder
+	sb.WriteString(e.msg)
+	for _, f := range e.Fields {
+		sb.WriteString("\n")
+		if f.Path != "" {
+			sb.WriteString(f.Path)
+			sb.WriteString(": ")
+		}
+		sb.WriteString(f.Message)
+	}
+	return sb.String()
+}
+
+// writeErrRsp writes err, listing the failing fields of validation errors and
+// the position of syntax errors.
+func writeErrRsp(w http.ResponseWriter, code int, err error) {
+	var ve *validationError
+	if errors.As(err, &ve) {
+		Rsp{"errorCode": code, "message": ve.Error(), "errors": ve.Fields}.WriteTo(w)
+		return
+	}
+	var se *syntaxError
+	if errors.As(err, &se) {
+		Rsp{"errorCode": code, "message": se.Error(), "errors": []*syntaxError{se}}.WriteTo(w)
+		return
+	}
+	Rsp{"errorCode": code, "message": err.Error()}.WriteTo(w)
+}
+
+func compileSchema(sc SchemaConf) (*jsonschema.Schema, error) {
+	b, err := os.ReadFile(sc.File)
+	if err != nil {
+		return nil, err
+	}
+
+	if ext := filepath.Ext(sc.File); ext == ".yaml" || ext == ".yml" {
+		b, err = yamlToJSON(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource(sc.File, bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return c.Compile(sc.File)
+}
+
+// validateSchema validates value against the schema of the longest configured
+// prefix of key. Values are parsed as JSON, or as YAML if they are not JSON.
+func (e *Etcd) validateSchema(key, value string) error {
+	var found *prefixSchema
+	for i := range e.schemas {
+		ps := &e.schemas[i]
+		if strings.HasPrefix(key, ps.prefix) && (found == nil || len(ps.prefix) > len(found.prefix)) {
+			found = ps
+		}
+	}
+
+	if found == nil {
+		return nil
+	}
+
+	b := []byte(value)
+	if !json.Valid(b) {
+		var err error
+		if b, err = yamlToJSON(b); err != nil {
+			return &validationError{msg: "The value is neither JSON nor YAML: " + err.Error()}
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return &validationError{msg: "The value is not valid JSON: " + err.Error()}
+	}
+
+	err := found.schema.Validate(doc)
+	if err == nil {
+		return nil
+	}
+
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+
+	verr := &validationError{msg: "The value does not match the schema of " + found.prefix}
+	collectFieldErrors(ve, &verr.Fields)
+	return verr
+}
+
+// collectFieldErrors flattens the leaf causes of a schema validation error.
+func collectFieldErrors(ve *jsonschema.ValidationError, fields *[]fieldError) {
+	if len(ve.Causes) == 0 {
+		*fields = append(*fields, fieldError{Path: ve.InstanceLocation, Message: ve.Message})
+		return
+	}
+	for _, c := range ve.Causes {
+		collectFieldErrors(c, fields)
+	}
+}
+
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v any
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("convert yaml to json: %w", err)
+	}
+	return b, nil
+}
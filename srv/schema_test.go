@@ -0,0 +1,87 @@
+package srv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app.json": `{
+  "type": "object",
+  "required": ["port"],
+  "properties": {
+    "port": {"type": "integer", "minimum": 1},
+    "name": {"type": "string"}
+  }
+}`,
+		"db.yaml": `type: object
+properties:
+  hosts:
+    type: array
+    items: {type: string}
+`,
+	}
+	for name, s := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cf := Etcd{Schemas: []SchemaConf{
+		{Prefix: "/app/", File: filepath.Join(dir, "app.json")},
+		{Prefix: "/app/db/", File: filepath.Join(dir, "db.yaml")},
+	}}
+	if err := cf.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		// fields are the paths of the failing fields, nil if the value is valid
+		fields []string
+		// invalid is set when the value can not be parsed
+		invalid bool
+	}{
+		{name: "no schema", key: "/other/x", value: "not json"},
+		{name: "json", key: "/app/web", value: `{"port": 80, "name": "web"}`},
+		{name: "yaml", key: "/app/web", value: "port: 80\nname: web\n"},
+		{name: "missing field", key: "/app/web", value: `{"name": "web"}`, fields: []string{""}},
+		{name: "several fields", key: "/app/web", value: `{"port": 0, "name": 1}`, fields: []string{"/name", "/port"}},
+		{name: "longest prefix", key: "/app/db/main", value: `{"hosts": ["a", "b"]}`},
+		{name: "longest prefix fails", key: "/app/db/main", value: "hosts: [a, 1]", fields: []string{"/hosts/1"}},
+		{name: "neither json nor yaml", key: "/app/web", value: "port: [", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := cf.validateSchema(tt.key, tt.value)
+			if tt.fields == nil && !tt.invalid {
+				if err != nil {
+					t.Fatalf("err = %v, want nil", err)
+				}
+				return
+			}
+
+			var ve *validationError
+			if !errors.As(err, &ve) {
+				t.Fatalf("err = %v, want a validation error", err)
+			}
+
+			var paths []string
+			for _, f := range ve.Fields {
+				paths = append(paths, f.Path)
+			}
+			slices.Sort(paths)
+			if !slices.Equal(paths, tt.fields) {
+				t.Errorf("paths = %q, want %q\n%v", paths, tt.fields, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ohler55/ojg/jp"
+	"github.com/welllog/olog"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+const (
+	searchDefaultLimit = 100
+	searchMaxLimit     = 1000
+	// searchMaxScan and searchMaxDuration bound the work of a single request,
+	// a search of a large prefix continues over several requests.
+	searchMaxScan     = 20000
+	searchMaxDuration = 3 * time.Second
+)
+
+// matcher reports whether a key or a value matches a search predicate.
+type matcher func(b []byte) bool
+
+func newMatcher(mode, q, match string) (matcher, error) {
+	switch mode {
+	case "", "substring":
+		sub := []byte(q)
+		return func(b []byte) bool {
+			return bytes.Contains(b, sub)
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(q)
+		if err != nil {
+			return nil, err
+		}
+		return re.Match, nil
+	case "jsonpath":
+		x, err := jp.ParseString(q)
+		if err != nil {
+			return nil, err
+		}
+		return func(b []byte) bool {
+			var data any
+			if json.Unmarshal(b, &data) != nil {
+				return false
+			}
+
+			for _, v := range x.Get(data) {
+				if match == "" {
+					return true
+				}
+
+				s, ok := v.(string)
+				if !ok {
+					bs, _ := json.Marshal(v)
+					s = string(bs)
+				}
+				if strings.Contains(s, match) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+}
+
+// Search scans the keys under a prefix and returns the ones whose name or value
+// matches the query. Values are matched as the editor shows them, decoded with the
+// configured codec. A search stops after limit matches, or when it used up its scan
+// budget, and returns the key to continue from.
+func (h *v3Handlers) Search(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	key := r.FormValue("key")
+	q := r.FormValue("q")
+	mode := r.FormValue("mode")
+	in := r.FormValue("in")
+
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method": r.Method,
+		"host":   cli.Host,
+		"uname":  cli.Username,
+		"key":    key,
+	})
+
+	logger.Debugf("SEARCH v3 %s %q", mode, q)
+
+	if q == "" {
+		Rsp{"errorCode": 400, "message": "The query is required."}.WriteTo(w)
+		return
+	}
+
+	match, err := newMatcher(mode, q, r.FormValue("match"))
+	if err != nil {
+		Rsp{"errorCode": 400, "message": "parse query failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	// jsonpath only applies to values
+	matchKey := (in == "" || in == "all" || in == "key") && mode != "jsonpath"
+	matchValue := in == "" || in == "all" || in == "value"
+
+	limit := searchDefaultLimit
+	if s := r.FormValue("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			Rsp{"errorCode": 400, "message": "invalid limit: " + s}.WriteTo(w)
+			return
+		}
+		limit = min(limit, searchMaxLimit)
+	}
+
+	ctx := r.Context()
+	ranges, err := readableRanges(ctx, cli.Client, key)
+	if err != nil {
+		logger.Warnf("get permission keys failed: %v", err)
+		Rsp{"errorCode": 500, "message": "get permission keys failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	deadline := time.Now().Add(searchMaxDuration)
+	var nodes []*Node
+	var scanned int
+	next, err := scanRanges(ctx, cli.Client, ranges, r.FormValue("continue"), func(kv *mvccpb.KeyValue) bool {
+		scanned++
+		if (matchKey && match(kv.Key)) || (matchValue && match(decodeMatched(&cf, kv))) {
+			node := &Node{
+				Key:           string(kv.Key),
+				CreatedIndex:  kv.CreateRevision,
+				ModifiedIndex: kv.ModRevision,
+				VersionIndex:  kv.Version,
+			}
+			node.setValue(&cf, kv.Value)
+			nodes = append(nodes, node)
+		}
+		return len(nodes) < limit && scanned < searchMaxScan && time.Now().Before(deadline)
+	})
+	if err != nil {
+		logger.Warnf("search failed: %v", err)
+		Rsp{"errorCode": 500, "message": "search failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	Rsp{"nodes": nodes, "total": len(nodes), "scanned": scanned, "next": next}.WriteTo(w)
+}
+
+// decodeMatched returns the value of kv decoded with the codec configured for its key,
+// values the codec fails to decode are matched as stored.
+func decodeMatched(cf *Etcd, kv *mvccpb.KeyValue) []byte {
+	if _, c, ok := cf.CodecFor(string(kv.Key)); ok {
+		if b, err := c.Decode(kv.Value); err == nil {
+			return b
+		}
+	}
+	return kv.Value
+}
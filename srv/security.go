@@ -0,0 +1,90 @@
+package srv
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/welllog/etcdkeeper-v3/srv/session"
+	"github.com/welllog/olog"
+)
+
+const (
+	csrfHeader     = "X-CSRF-Token"
+	csrfCookieName = "_etcdkeeper_csrf"
+)
+
+// contentSecurityPolicy allows the inline scripts of the page and the eval easyui
+// uses to parse data-options, but no other origins.
+const contentSecurityPolicy = "default-src 'self'; script-src 'self' 'unsafe-inline' 'unsafe-eval'; " +
+	"style-src 'self' 'unsafe-inline'; img-src 'self' data:; worker-src 'self' blob:; " +
+	"connect-src 'self'; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+
+// withSecurityHeaders sets headers that keep browsers from framing, sniffing or
+// loading foreign content into the page.
+func withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", contentSecurityPolicy)
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Cross-Origin-Opener-Policy", "same-origin")
+		if r.TLS != nil {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfProtect requires requests that change state to send the CSRF token of their
+// session in the X-CSRF-Token header. The token is handed to the page in a cookie
+// scripts can read, which other sites can not.
+func (h *v3Handlers) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !csrfScoped(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sess := h.sessmgr.SessionStart(w, r)
+		// the handlers of the request use this session instead of reading it again
+		r = r.WithContext(session.NewContext(r.Context(), sess))
+
+		token := h.csrfToken(w, r, sess.SessionID())
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			sent := r.Header.Get(csrfHeader)
+			if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				olog.Infof("%s %s from %s: invalid csrf token", r.Method, r.URL.Path, r.RemoteAddr)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errorCode":403,"message":"Invalid CSRF token, please try again."}`))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfScoped reports whether path is served by the handlers rather than the assets.
+func csrfScoped(path string) bool {
+	return path == "/" || path == "/hosts" || strings.HasPrefix(path, "/v3/")
+}
+
+// csrfToken returns the token of the session sid and sends it in the cookie
+// unless the browser already has it.
+func (h *v3Handlers) csrfToken(w http.ResponseWriter, r *http.Request, sid string) string {
+	token := h.creds.csrfToken(sid)
+	if c, err := r.Cookie(csrfCookieName); err != nil || c.Value != token {
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    token,
+			Path:     "/",
+			Secure:   h.conf.Load().Session.Secure,
+			SameSite: h.conf.Load().Session.sameSite(),
+		})
+	}
+	return token
+}
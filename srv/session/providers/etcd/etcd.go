@@ -0,0 +1,295 @@
+// Package etcd stores sessions in etcd so replicas of etcdkeeper share them. A
+// session is a marker key under the prefix named after the hash of its id, each
+// value is a gob encoded key below it, all attached to one lease that expires the
+// session. Sessions are written on their first Set. Values stored in sessions must
+// be registered with gob.Register.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/welllog/etcdkeeper-v3/srv/session"
+	"github.com/welllog/olog"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	defaultPrefix = "/etcdkeeper/sessions/"
+	opTimeout     = 5 * time.Second
+	// refreshInterval limits how often reads keep the lease of a session alive.
+	refreshInterval = time.Minute
+)
+
+var p = &Provider{refreshed: make(map[string]int64, 10)}
+
+type SessionStore struct {
+	sid    string
+	key    string
+	lease  clientv3.LeaseID
+	pder   *Provider
+	values map[string]any
+	lock   sync.Mutex
+}
+
+func (st *SessionStore) Set(key string, value any) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&value); err != nil {
+		olog.Warnf("encode session value %s: %v", key, err)
+		return err
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if err := st.put(key, buf.String()); err != nil {
+		olog.Warnf("save session value %s: %v", key, err)
+		return err
+	}
+	st.values[key] = value
+	return nil
+}
+
+func (st *SessionStore) Get(key string) (any, bool) {
+	st.lock.Lock()
+	v, ok := st.values[key]
+	st.lock.Unlock()
+	return v, ok
+}
+
+func (st *SessionStore) Delete(key string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.lease == clientv3.NoLease {
+		// the session was never written
+		delete(st.values, key)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+
+	if _, err := st.pder.cli.Delete(ctx, st.key+"/"+key); err != nil {
+		olog.Warnf("delete session value %s: %v", key, err)
+		return err
+	}
+	delete(st.values, key)
+	return nil
+}
+
+func (st *SessionStore) SessionID() string {
+	return st.sid
+}
+
+// put writes a value with the lease of the session, the session is created on
+// the first write and again if it expired.
+func (st *SessionStore) put(key, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+
+	if st.lease != clientv3.NoLease {
+		_, err := st.pder.cli.Put(ctx, st.key+"/"+key, value, clientv3.WithLease(st.lease))
+		if !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			return err
+		}
+	}
+
+	lease, err := st.pder.create(ctx, st.key)
+	if err != nil {
+		return err
+	}
+	st.lease = lease
+
+	// values read before the session expired are written again with the new lease
+	ops := make([]clientv3.Op, 0, len(st.values)+1)
+	for k, v := range st.values {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+			return err
+		}
+		ops = append(ops, clientv3.OpPut(st.key+"/"+k, buf.String(), clientv3.WithLease(lease)))
+	}
+	ops = append(ops, clientv3.OpPut(st.key+"/"+key, value, clientv3.WithLease(lease)))
+	_, err = st.pder.cli.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+type Provider struct {
+	cli    *clientv3.Client
+	prefix string
+	ttl    int64
+
+	lock      sync.Mutex
+	refreshed map[string]int64 // last lease refresh of sessions read by this replica
+}
+
+// Configure connects to etcd. Options are endpoints (comma separated), username,
+// password, certFile, keyFile, trustedCAFile and prefix.
+func (pder *Provider) Configure(options map[string]string, maxlifetime int64) error {
+	if options["endpoints"] == "" {
+		return errors.New("endpoints are required")
+	}
+
+	var tlsConfig *tls.Config
+	if options["certFile"] != "" || options["trustedCAFile"] != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      options["certFile"],
+			KeyFile:       options["keyFile"],
+			TrustedCAFile: options["trustedCAFile"],
+		}
+		var err error
+		tlsConfig, err = tlsInfo.ClientConfig()
+		if err != nil {
+			return fmt.Errorf("tls config failed: %w", err)
+		}
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:            strings.Split(options["endpoints"], ","),
+		DialTimeout:          10 * time.Second,
+		TLS:                  tlsConfig,
+		DialKeepAliveTime:    time.Minute,
+		DialKeepAliveTimeout: time.Minute,
+		Username:             options["username"],
+		Password:             options["password"],
+	})
+	if err != nil {
+		return fmt.Errorf("etcd connect failed: %w", err)
+	}
+
+	pder.cli = cli
+	pder.prefix = options["prefix"]
+	if pder.prefix == "" {
+		pder.prefix = defaultPrefix
+	}
+	pder.ttl = maxlifetime
+	return nil
+}
+
+// SessionInit returns a session kept in memory, it is written to etcd on the
+// first Set, so requests that never log in do not create leases and keys.
+func (pder *Provider) SessionInit(sid string) (session.Session, error) {
+	return pder.newStore(sid), nil
+}
+
+func (pder *Provider) SessionRead(sid string) (session.Session, error) {
+	sess := pder.newStore(sid)
+
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+
+	rsp, err := pder.cli.Get(ctx, sess.key, clientv3.WithPrefix())
+	if err != nil {
+		olog.Warnf("read session: %v", err)
+		return sess, err
+	}
+	if len(rsp.Kvs) == 0 {
+		return sess, nil
+	}
+
+	for _, kv := range rsp.Kvs {
+		sess.lease = clientv3.LeaseID(kv.Lease)
+		name, ok := strings.CutPrefix(string(kv.Key), sess.key+"/")
+		if !ok {
+			continue
+		}
+
+		var v any
+		if err := gob.NewDecoder(bytes.NewReader(kv.Value)).Decode(&v); err != nil {
+			olog.Warnf("decode session value %s: %v", name, err)
+			continue
+		}
+		sess.values[name] = v
+	}
+
+	pder.refresh(ctx, sid, sess.lease)
+	return sess, nil
+}
+
+func (pder *Provider) SessionDestroy(sid string) error {
+	pder.lock.Lock()
+	delete(pder.refreshed, sid)
+	pder.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+
+	_, err := pder.cli.Delete(ctx, pder.key(sid), clientv3.WithPrefix())
+	return err
+}
+
+// SessionGC forgets the refresh times of expired sessions, etcd expires the
+// sessions themselves with their leases.
+func (pder *Provider) SessionGC(maxlifetime int64) {
+	deadline := time.Now().Unix() - maxlifetime
+
+	pder.lock.Lock()
+	for sid, t := range pder.refreshed {
+		if t <= deadline {
+			delete(pder.refreshed, sid)
+		}
+	}
+	pder.lock.Unlock()
+}
+
+// create grants a lease and writes the marker key of a session.
+func (pder *Provider) create(ctx context.Context, key string) (clientv3.LeaseID, error) {
+	grant, err := pder.cli.Grant(ctx, pder.ttl)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+
+	if _, err := pder.cli.Put(ctx, key, "", clientv3.WithLease(grant.ID)); err != nil {
+		_, _ = pder.cli.Revoke(ctx, grant.ID)
+		return clientv3.NoLease, err
+	}
+	return grant.ID, nil
+}
+
+// refresh keeps the lease of a read session alive, at most once per refreshInterval.
+func (pder *Provider) refresh(ctx context.Context, sid string, lease clientv3.LeaseID) {
+	now := time.Now().Unix()
+
+	pder.lock.Lock()
+	if now-pder.refreshed[sid] < int64(refreshInterval/time.Second) {
+		pder.lock.Unlock()
+		return
+	}
+	pder.refreshed[sid] = now
+	pder.lock.Unlock()
+
+	if _, err := pder.cli.KeepAliveOnce(ctx, lease); err != nil {
+		olog.Warnf("refresh session: %v", err)
+	}
+}
+
+func (pder *Provider) newStore(sid string) *SessionStore {
+	return &SessionStore{
+		sid:    sid,
+		key:    pder.key(sid),
+		pder:   pder,
+		values: make(map[string]any, 2),
+	}
+}
+
+// key hashes sid, which comes from the cookie, into the key of the session.
+func (pder *Provider) key(sid string) string {
+	sum := sha256.Sum256([]byte(sid))
+	return pder.prefix + hex.EncodeToString(sum[:])
+}
+
+func init() {
+	session.Register("etcd", p)
+}
@@ -0,0 +1,255 @@
+// Package file stores sessions on disk so they survive restarts. Each session is
+// a gob encoded file named after the hash of its id, values stored in sessions
+// must be registered with gob.Register.
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/welllog/etcdkeeper-v3/srv/session"
+	"github.com/welllog/olog"
+)
+
+const (
+	defaultDir = "./sessions"
+	fileExt    = ".sess"
+	// touchInterval limits how often reads refresh the modification time of a file.
+	touchInterval = time.Minute
+)
+
+var p = &Provider{
+	dir:      defaultDir,
+	sessions: make(map[string]*SessionStore, 10),
+}
+
+type SessionStore struct {
+	sid          string
+	path         string
+	timeAccessed int64
+	timeTouched  int64
+	values       map[string]any
+	lock         sync.Mutex
+}
+
+func (st *SessionStore) Set(key string, value any) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.values[key] = value
+	return st.save()
+}
+
+func (st *SessionStore) Get(key string) (any, bool) {
+	st.lock.Lock()
+	v, ok := st.values[key]
+	st.lock.Unlock()
+	return v, ok
+}
+
+func (st *SessionStore) Delete(key string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if _, ok := st.values[key]; !ok {
+		return nil
+	}
+	delete(st.values, key)
+	return st.save()
+}
+
+func (st *SessionStore) SessionID() string {
+	return st.sid
+}
+
+// save writes the values to a temporary file and renames it, so a crash never
+// leaves a partly written session behind.
+func (st *SessionStore) save() error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(st.values); err != nil {
+		olog.Warnf("encode session: %v", err)
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(st.path), "tmp-*")
+	if err != nil {
+		olog.Warnf("save session: %v", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), st.path)
+	}
+	if err != nil {
+		olog.Warnf("save session: %v", err)
+		return err
+	}
+
+	st.timeTouched = time.Now().Unix()
+	return nil
+}
+
+// touch refreshes the modification time of the file, which the garbage
+// collection goes by for sessions that are not loaded.
+func (st *SessionStore) touch(now int64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if now-st.timeTouched < int64(touchInterval/time.Second) {
+		return
+	}
+	st.timeTouched = now
+	t := time.Unix(now, 0)
+	if err := os.Chtimes(st.path, t, t); err != nil && !errors.Is(err, os.ErrNotExist) {
+		olog.Warnf("touch session: %v", err)
+	}
+}
+
+type Provider struct {
+	lock     sync.Mutex
+	dir      string
+	sessions map[string]*SessionStore // sessions loaded since start
+}
+
+// Configure sets the directory sessions are stored in with the dir option.
+func (pder *Provider) Configure(options map[string]string, _ int64) error {
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	if dir := options["dir"]; dir != "" {
+		pder.dir = dir
+	}
+	if err := os.MkdirAll(pder.dir, 0o700); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (pder *Provider) SessionInit(sid string) (session.Session, error) {
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	sess := pder.newStore(sid, make(map[string]any, 2))
+	return sess, sess.save()
+}
+
+func (pder *Provider) SessionRead(sid string) (session.Session, error) {
+	now := time.Now().Unix()
+
+	pder.lock.Lock()
+	sess, ok := pder.sessions[sid]
+	if !ok {
+		values, err := pder.load(sid)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				olog.Warnf("load session: %v", err)
+			}
+			pder.lock.Unlock()
+			return pder.SessionInit(sid)
+		}
+		sess = pder.newStore(sid, values)
+	}
+	sess.timeAccessed = now
+	pder.lock.Unlock()
+
+	sess.touch(now)
+	return sess, nil
+}
+
+func (pder *Provider) SessionDestroy(sid string) error {
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	delete(pder.sessions, sid)
+	err := os.Remove(pder.path(sid))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SessionGC removes the sessions not accessed within maxlifetime, including those
+// left on disk by previous runs.
+func (pder *Provider) SessionGC(maxlifetime int64) {
+	deadline := time.Now().Unix() - maxlifetime
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	for sid, sess := range pder.sessions {
+		if sess.timeAccessed <= deadline {
+			delete(pder.sessions, sid)
+		}
+	}
+
+	entries, err := os.ReadDir(pder.dir)
+	if err != nil {
+		olog.Warnf("session gc: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, fileExt) && !strings.HasPrefix(name, "tmp-") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().Unix() > deadline {
+			continue
+		}
+		if err := os.Remove(filepath.Join(pder.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			olog.Warnf("session gc: %v", err)
+		}
+	}
+}
+
+func (pder *Provider) newStore(sid string, values map[string]any) *SessionStore {
+	sess := &SessionStore{
+		sid:          sid,
+		path:         pder.path(sid),
+		timeAccessed: time.Now().Unix(),
+		values:       values,
+	}
+	pder.sessions[sid] = sess
+	return sess
+}
+
+func (pder *Provider) load(sid string) (map[string]any, error) {
+	b, err := os.ReadFile(pder.path(sid))
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]any
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&values); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", pder.path(sid), err)
+	}
+	if values == nil {
+		values = make(map[string]any, 2)
+	}
+	return values, nil
+}
+
+// path hashes sid, which comes from the cookie, into a file name.
+func (pder *Provider) path(sid string) string {
+	sum := sha256.Sum256([]byte(sid))
+	return filepath.Join(pder.dir, hex.EncodeToString(sum[:])+fileExt)
+}
+
+func init() {
+	session.Register("file", p)
+}
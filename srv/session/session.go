@@ -1,6 +1,7 @@
 package session
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
@@ -24,6 +25,12 @@ type Provider interface {
 	SessionGC(maxlifetime int64)
 }
 
+// Configurer is implemented by providers that take options from the configuration,
+// maxlifetime is the lifetime of sessions in seconds.
+type Configurer interface {
+	Configure(options map[string]string, maxlifetime int64) error
+}
+
 var provides = make(map[string]Provider)
 
 // Register makes a session provide available by the provided name.
@@ -43,24 +50,59 @@ type Manager struct {
 	cookieName  string //private cookiename
 	provider    Provider
 	maxlifetime int64
+	secure      bool
+	sameSite    http.SameSite
+	onGC        []func()
 }
 
-func NewManager(provideName, cookieName string, maxlifetime int64) (*Manager, error) {
+func NewManager(provideName, cookieName string, maxlifetime int64, options map[string]string) (*Manager, error) {
 	provider, ok := provides[provideName]
 	if !ok {
 		return nil, fmt.Errorf("session: unknown provide %q (forgotten import?)", provideName)
 	}
-	return &Manager{provider: provider, cookieName: cookieName, maxlifetime: maxlifetime}, nil
+	if c, ok := provider.(Configurer); ok {
+		if err := c.Configure(options, maxlifetime); err != nil {
+			return nil, fmt.Errorf("session: configure provide %q: %w", provideName, err)
+		}
+	}
+	return &Manager{provider: provider, cookieName: cookieName, maxlifetime: maxlifetime, sameSite: http.SameSiteLaxMode}, nil
+}
+
+// SetCookieAttributes sets the Secure and SameSite attributes of the session cookie.
+func (manager *Manager) SetCookieAttributes(secure bool, sameSite http.SameSite) {
+	manager.secure = secure
+	manager.sameSite = sameSite
+}
+
+// OnGC registers fn to run with every garbage collection of the sessions, to
+// forget state kept for sessions elsewhere. It must be called before GC.
+func (manager *Manager) OnGC(fn func()) {
+	manager.onGC = append(manager.onGC, fn)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying sess. SessionStart returns sess for
+// requests with this context instead of reading the session again.
+func NewContext(ctx context.Context, sess Session) context.Context {
+	return context.WithValue(ctx, contextKey{}, sess)
 }
 
 // get Session
 func (manager *Manager) SessionStart(w http.ResponseWriter, r *http.Request) (session Session) {
+	if sess, ok := r.Context().Value(contextKey{}).(Session); ok {
+		return sess
+	}
+
 	cookie, err := r.Cookie(manager.cookieName)
 	if err != nil || cookie.Value == "" {
 		sid := manager.sessionId()
 		session, _ = manager.provider.SessionInit(sid)
-		cookie := http.Cookie{Name: manager.cookieName, Value: url.QueryEscape(sid), Path: "/", HttpOnly: true, MaxAge: int(manager.maxlifetime)}
+		cookie := http.Cookie{Name: manager.cookieName, Value: url.QueryEscape(sid), Path: "/", HttpOnly: true, MaxAge: int(manager.maxlifetime),
+			Secure: manager.secure, SameSite: manager.sameSite}
 		http.SetCookie(w, &cookie)
+		// later calls for the same request find the new session
+		r.AddCookie(&cookie)
 	} else {
 		sid, _ := url.QueryUnescape(cookie.Value)
 		session, _ = manager.provider.SessionRead(sid)
@@ -74,15 +116,20 @@ func (manager *Manager) SessionDestroy(w http.ResponseWriter, r *http.Request) {
 	if err != nil || cookie.Value == "" {
 		return
 	} else {
-		manager.provider.SessionDestroy(cookie.Value)
+		sid, _ := url.QueryUnescape(cookie.Value)
+		manager.provider.SessionDestroy(sid)
 		expiration := time.Now()
-		cookie := http.Cookie{Name: manager.cookieName, Path: "/", HttpOnly: true, Expires: expiration, MaxAge: -1}
+		cookie := http.Cookie{Name: manager.cookieName, Path: "/", HttpOnly: true, Expires: expiration, MaxAge: -1,
+			Secure: manager.secure, SameSite: manager.sameSite}
 		http.SetCookie(w, &cookie)
 	}
 }
 
 func (manager *Manager) GC() {
 	manager.provider.SessionGC(manager.maxlifetime)
+	for _, fn := range manager.onGC {
+		fn()
+	}
 	time.AfterFunc(time.Duration(manager.maxlifetime)*time.Second, func() { manager.GC() })
 }
 
@@ -2,24 +2,39 @@ package srv
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"io/fs"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/pkg/browser"
+	"github.com/welllog/etcdkeeper-v3/srv/etcdmgr"
+	_ "github.com/welllog/etcdkeeper-v3/srv/session/providers/etcd"
+	_ "github.com/welllog/etcdkeeper-v3/srv/session/providers/file"
 	_ "github.com/welllog/etcdkeeper-v3/srv/session/providers/memory"
 	"github.com/welllog/olog"
 )
 
 type Server struct {
-	srv   http.Server
-	debug bool
+	srv     http.Server
+	v3      *v3Handlers
+	clients *etcdmgr.EtcdManager
+	debug   bool
+	// tls is the config of the current certificate files, it is replaced on reload.
+	tls atomic.Pointer[tls.Config]
+	// confFile is watched for changes once WatchConfig is called.
+	confFile string
+	// mu guards hooks, which are replaced on reload.
+	mu    sync.Mutex
+	hooks *webhookDispatcher
 }
 
 func NewServer(cf Conf, assets fs.FS) *Server {
@@ -46,39 +61,68 @@ func NewServer(cf Conf, assets fs.FS) *Server {
 	})
 	bindV3Router(mux, v3)
 
-	return &Server{
-		srv:   http.Server{Addr: cf.Host + ":" + strconv.Itoa(cf.Port), Handler: mux},
-		debug: cf.Debug,
+	s := &Server{
+		srv: http.Server{
+			Addr:    cf.Host + ":" + strconv.Itoa(cf.Port),
+			Handler: withSecurityHeaders(v3.withIdentity(v3.csrfProtect(mux))),
+		},
+		v3:      v3,
+		hooks:   newWebhookDispatcher(cf),
+		clients: v3.climgr,
+		debug:   cf.Debug,
 	}
+
+	if cf.Tls.Enable {
+		tlsConfig, err := newServerTLSConfig(cf.Tls)
+		if err != nil {
+			olog.Fatalf("server tls config: %v", err)
+		}
+		s.tls.Store(tlsConfig)
+		// handshakes use the config of the time, so reloads apply to new connections
+		s.srv.TLSConfig = &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return s.tls.Load(), nil
+			},
+		}
+	}
+
+	return s
 }
 
 func (s *Server) Start() {
+	s.hooks.Start()
+	stopWatch := s.watchConfig()
+
+	// listen before serving, so the server is ready once Listen returns, also when
+	// clients must present a certificate
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		olog.Fatalf("http listen %s error: %v", s.srv.Addr, err)
+	}
+
+	scheme := "http"
+	if s.srv.TLSConfig != nil {
+		scheme = "https"
+	}
+
 	go func() {
-		if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			olog.Fatalf("http listen %s error: %v", s.srv.Addr, err)
+		var err error
+		if s.srv.TLSConfig != nil {
+			err = s.srv.ServeTLS(ln, "", "")
+		} else {
+			err = s.srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			olog.Fatalf("http serve %s error: %v", s.srv.Addr, err)
 		}
 	}()
 
-	go func() {
-		uri := fmt.Sprintf("http://%s/ping", s.srv.Addr)
-		for i := 0; i < 15; i++ {
-			resp, err := http.Get(uri)
-			if err == nil && resp.StatusCode == 200 {
-				olog.Infof("http server is ready on %s", s.srv.Addr)
-				if os.Getenv("ETCDKEEPER_X_NO_BROWSER") == "" && !s.debug {
-					if err := browser.OpenURL("http://" + s.srv.Addr); err != nil {
-						olog.Warnf("open browser: %v", err)
-					}
-				}
-				return
-			}
-
-			olog.Debug("waiting for the router, retry in 1 second.")
-			time.Sleep(time.Second)
+	olog.Infof("http server is ready on %s://%s", scheme, s.srv.Addr)
+	if os.Getenv("ETCDKEEPER_X_NO_BROWSER") == "" && !s.debug {
+		if err := browser.OpenURL(scheme + "://" + s.srv.Addr); err != nil {
+			olog.Warnf("open browser: %v", err)
 		}
-
-		olog.Fatal("http server is not ready.")
-	}()
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -90,5 +134,12 @@ func (s *Server) Start() {
 		olog.Fatalf("http server shutdown err: %s", err.Error())
 	}
 
+	stopWatch()
+	s.mu.Lock()
+	s.hooks.Stop(ctx)
+	s.mu.Unlock()
+	// handlers are done, the clients are no longer borrowed
+	s.clients.Close()
+
 	olog.Info("http server shutdown")
 }
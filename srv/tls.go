@@ -0,0 +1,181 @@
+package srv
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/welllog/olog"
+)
+
+// certCheckInterval limits how often the certificate files are checked for changes.
+const certCheckInterval = time.Second
+
+// ServerTls configures HTTPS for the etcdkeeper server.
+type ServerTls struct {
+	Enable   bool   `yaml:"enable"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCAFile enables mutual TLS, client certificates must be signed by one of its CAs.
+	ClientCAFile string `yaml:"clientCAFile"`
+	// ClientAuth is require (default) or optional, optional accepts clients without certificate.
+	ClientAuth string `yaml:"clientAuth"`
+	// Identities maps the common name or the full subject of client certificates to
+	// user names, unmapped certificates are identified by their common name.
+	Identities map[string]string `yaml:"identities"`
+}
+
+type identityKey struct{}
+
+// certReloader serves the certificate of the key pair files, reloading them when
+// they are modified.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if mod, err := c.lastModified(); err != nil {
+			olog.Warnf("check certificate: %v", err)
+		} else if !mod.Equal(c.modTime) {
+			if err := c.reload(); err != nil {
+				olog.Warnf("reload certificate, keep the old one: %v", err)
+			} else {
+				olog.Infof("certificate %s reloaded", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *certReloader) reload() error {
+	mod, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.modTime = mod
+	return nil
+}
+
+// lastModified returns the later modification time of the two files.
+func (c *certReloader) lastModified() (time.Time, error) {
+	ci, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ki, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if ki.ModTime().After(ci.ModTime()) {
+		return ki.ModTime(), nil
+	}
+	return ci.ModTime(), nil
+}
+
+func newServerTLSConfig(t ServerTls) (*tls.Config, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("certFile and keyFile are required")
+	}
+
+	reloader, err := newCertReloader(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if t.ClientCAFile != "" {
+		b, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", t.ClientCAFile)
+		}
+		conf.ClientCAs = pool
+
+		switch t.ClientAuth {
+		case "", "require":
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			conf.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown clientAuth %q", t.ClientAuth)
+		}
+	}
+	return conf, nil
+}
+
+// withIdentity attaches the identity of the verified client certificate to requests.
+func (h *v3Handlers) withIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			identities := h.conf.Load().Tls.Identities
+			subject := r.TLS.VerifiedChains[0][0].Subject
+			name, ok := identities[subject.String()]
+			if !ok {
+				name, ok = identities[subject.CommonName]
+			}
+			if !ok {
+				name = subject.CommonName
+			}
+			r = r.WithContext(context.WithValue(r.Context(), identityKey{}, name))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certIdentity returns the identity of the client certificate of the request.
+func certIdentity(ctx context.Context) string {
+	name, _ := ctx.Value(identityKey{}).(string)
+	return name
+}
+
+// identity returns the user a request acts as, the identity of its client
+// certificate or else the etcd user of cli.
+func identity(r *http.Request, cli *clientv3.Client) string {
+	if name := certIdentity(r.Context()); name != "" {
+		return name
+	}
+	return cli.Username
+}
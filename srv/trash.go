@@ -0,0 +1,599 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/welllog/olog"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	trashDefaultRetention = 168
+	// txnBatchSize keeps transactions below the default --max-txn-ops of 128.
+	txnBatchSize       = 100
+	deletePreviewLimit = 100
+	// trashMaxKeys limits directory deletes kept in the trash, their keys are read
+	// into memory and copied to the trash before the delete.
+	trashMaxKeys = 10000
+)
+
+// TrashConf keeps deleted keys under Prefix so that deletes can be undone. Deleted
+// keys are stored with a lease and expire after Retention hours. Every etcd user
+// has a trash of its own under <Prefix><user>/, so its entries can be protected
+// by the permissions of etcd.
+type TrashConf struct {
+	Prefix    string `yaml:"prefix"`
+	Retention int    `yaml:"retention"`
+}
+
+// trashEntry describes one delete kept in the trash. The entry is stored under
+// <prefix><user>/meta/<id>, the removed keys under <prefix><user>/data/<id>/<key>,
+// all of them share a lease.
+type trashEntry struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+	Dir bool   `json:"dir"`
+	// Keys lists the keys of a delete of several single keys, Key is the first.
+	Keys      []string `json:"keys,omitempty"`
+	Revision  int64    `json:"revision"`
+	User      string   `json:"user"`
+	Count     int      `json:"count"`
+	DeletedAt int64    `json:"deletedAt"`
+	ExpiresAt int64    `json:"expiresAt"`
+}
+
+var (
+	errKeysChanged   = errors.New("keys changed after they were read")
+	errTrashTooLarge = fmt.Errorf("more than %d keys can not be kept in the trash, delete smaller directories", trashMaxKeys)
+)
+
+func (t *TrashConf) Default() {
+	if t.Retention <= 0 {
+		t.Retention = trashDefaultRetention
+	}
+}
+
+// userPrefix returns the trash of the etcd user, clients without a user share
+// the one of the empty name.
+func (t *TrashConf) userPrefix(user string) string {
+	return t.Prefix + url.PathEscape(user) + "/"
+}
+
+func (t *TrashConf) metaKey(user, id string) string {
+	return t.userPrefix(user) + "meta/" + id
+}
+
+func (t *TrashConf) dataPrefix(user, id string) string {
+	return t.userPrefix(user) + "data/" + id + "/"
+}
+
+// touches reports whether deleting [key, end) would remove keys of the trash.
+func (t *TrashConf) touches(key, end string) bool {
+	if t.Prefix == "" {
+		return false
+	}
+	if end == "" {
+		return strings.HasPrefix(key, t.Prefix)
+	}
+	return rangeOverlapsPrefix(key, end, t.Prefix)
+}
+
+// previewDelete writes the number of keys a directory delete removes and the first
+// of them, with the revision the delete must be confirmed at.
+func previewDelete(ctx context.Context, w http.ResponseWriter, cli *clientv3.Client, cf *Etcd, key string) {
+	countRsp, err := cli.Get(ctx, key, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	rev := countRsp.Header.Revision
+	getRsp, err := cli.Get(ctx, key, clientv3.WithPrefix(), clientv3.WithKeysOnly(),
+		clientv3.WithLimit(deletePreviewLimit), clientv3.WithRev(rev))
+	if err != nil {
+		Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	keys := make([]string, len(getRsp.Kvs))
+	for i, kv := range getRsp.Kvs {
+		keys[i] = string(kv.Key)
+	}
+
+	rsp := Rsp{
+		"status":   "preview",
+		"key":      key,
+		"revision": rev,
+		"total":    countRsp.Count,
+		"keys":     keys,
+	}
+	if cf.Trash.Prefix != "" {
+		rsp["trash"] = true
+		if countRsp.Count > trashMaxKeys {
+			rsp["message"] = errTrashTooLarge.Error()
+		}
+	}
+	rsp.WriteTo(w)
+}
+
+// deleteKeys deletes key, or every key with prefix key if dir is set, unless some
+// of them changed after rev. A rev of 0 means the current revision. The deleted
+// keys are kept in the trash if it is enabled, which holds at most trashMaxKeys
+// keys per delete.
+func deleteKeys(ctx context.Context, cli *clientv3.Client, cf *Etcd, user, key string, dir bool, rev int64) (int, error) {
+	kr := keyRange{from: key, end: key + "\x00"}
+	var delOpts []clientv3.OpOption
+	if dir {
+		kr.end = clientv3.GetPrefixRangeEnd(key)
+		delOpts = append(delOpts, clientv3.WithPrefix())
+	}
+
+	countOpts := []clientv3.OpOption{clientv3.WithRange(kr.end), clientv3.WithCountOnly()}
+	if rev > 0 {
+		countOpts = append(countOpts, clientv3.WithRev(rev))
+	}
+	countRsp, err := cli.Get(ctx, keyOrMin(kr.from), countOpts...)
+	if err != nil {
+		return 0, err
+	}
+	if rev == 0 {
+		rev = countRsp.Header.Revision
+	}
+	if cf.Trash.Prefix != "" && countRsp.Count > trashMaxKeys {
+		return 0, errTrashTooLarge
+	}
+
+	kvs, err := readKvs(ctx, cli, kr, rev)
+	if err != nil {
+		return 0, err
+	}
+
+	ops := []clientv3.Op{clientv3.OpDelete(key, delOpts...)}
+	t, err := keepInTrash(ctx, cli, cf, trashEntry{Key: key, Dir: dir, User: user}, kvs)
+	if err != nil {
+		return 0, err
+	}
+	if t != nil {
+		ops = append(ops, t.op())
+	}
+
+	txnRsp, err := cli.Txn(ctx).If(unchangedSince(key, dir, rev)).Then(ops...).Commit()
+	if err == nil && !txnRsp.Succeeded {
+		err = errKeysChanged
+	}
+	t.finish(ctx, cli, txnRsp, err)
+	if err != nil {
+		return 0, err
+	}
+	return len(kvs), nil
+}
+
+// pendingTrash is a trash entry whose keys are saved, it is written together
+// with the delete of the keys.
+type pendingTrash struct {
+	key   string
+	e     trashEntry
+	lease clientv3.LeaseID
+}
+
+// keepInTrash saves kvs in the trash of the client's user before they are
+// deleted. The delete must write op of the returned entry in its transaction and
+// call finish with its result. It returns nil if the trash is disabled or kvs is
+// empty, nil entries do nothing.
+func keepInTrash(ctx context.Context, cli *clientv3.Client, cf *Etcd, e trashEntry, kvs []*mvccpb.KeyValue) (*pendingTrash, error) {
+	if cf.Trash.Prefix == "" || len(kvs) == 0 {
+		return nil, nil
+	}
+
+	t := &pendingTrash{e: e}
+	var err error
+	t.lease, err = saveToTrash(ctx, cli, cf, &t.e, kvs)
+	if err != nil {
+		return nil, fmt.Errorf("save to trash: %w", err)
+	}
+	t.key = cf.Trash.metaKey(cli.Username, t.e.ID)
+	return t, nil
+}
+
+// readDeleted reads the values of the keys deleted by ops to keep them in the
+// trash, only deletes of single keys are read.
+func readDeleted(ctx context.Context, cli *clientv3.Client, ops []clientv3.Op) ([]*mvccpb.KeyValue, error) {
+	var gets []clientv3.Op
+	for _, op := range ops {
+		if op.IsDelete() {
+			gets = append(gets, clientv3.OpGet(string(op.KeyBytes())))
+		}
+	}
+	if len(gets) == 0 {
+		return nil, nil
+	}
+
+	txnRsp, err := cli.Txn(ctx).Then(gets...).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	var kvs []*mvccpb.KeyValue
+	for _, rsp := range txnRsp.Responses {
+		kvs = append(kvs, rsp.GetResponseRange().Kvs...)
+	}
+	return kvs, nil
+}
+
+// op writes the entry, its revision is filled in by finish.
+func (t *pendingTrash) op() clientv3.Op {
+	b, _ := json.Marshal(t.e)
+	return clientv3.OpPut(t.key, string(b), clientv3.WithLease(t.lease))
+}
+
+// finish removes the saved keys if the delete failed and sets the revision of
+// the entry otherwise.
+func (t *pendingTrash) finish(ctx context.Context, cli *clientv3.Client, txnRsp *clientv3.TxnResponse, err error) {
+	if t == nil {
+		return
+	}
+
+	if err != nil || !txnRsp.Succeeded {
+		if _, rerr := cli.Revoke(context.WithoutCancel(ctx), t.lease); rerr != nil {
+			olog.Warnf("revoke trash lease %x: %v", t.lease, rerr)
+		}
+		return
+	}
+
+	t.e.Revision = txnRsp.Header.Revision
+	if _, err := cli.Do(ctx, t.op()); err != nil {
+		olog.Warnf("set revision of trash entry %s: %v", t.e.ID, err)
+	}
+}
+
+// unchangedSince compares that key, or no key under it if dir is set, was
+// modified after rev.
+func unchangedSince(key string, dir bool, rev int64) clientv3.Cmp {
+	if !dir {
+		return clientv3.Compare(clientv3.ModRevision(key), "<", rev+1)
+	}
+	if key == "" {
+		return clientv3.Compare(clientv3.ModRevision("\x00"), "<", rev+1).WithRange("\x00")
+	}
+	return clientv3.Compare(clientv3.ModRevision(key), "<", rev+1).WithPrefix()
+}
+
+// saveToTrash writes kvs to the trash with a new lease and fills in the entry, which
+// must be written together with the delete.
+func saveToTrash(ctx context.Context, cli *clientv3.Client, cf *Etcd, e *trashEntry, kvs []*mvccpb.KeyValue) (clientv3.LeaseID, error) {
+	ttl := int64(cf.Trash.Retention) * 3600
+	leaseRsp, err := cli.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	e.ID = fmt.Sprintf("%019d-%s", now, newProposalID()[:8])
+	e.Count = len(kvs)
+	e.DeletedAt = now
+	e.ExpiresAt = now + ttl
+
+	prefix := cf.Trash.dataPrefix(cli.Username, e.ID)
+	ops := make([]clientv3.Op, len(kvs))
+	for i, kv := range kvs {
+		ops[i] = clientv3.OpPut(prefix+string(kv.Key), string(kv.Value), clientv3.WithLease(leaseRsp.ID))
+	}
+	if err := commitBatches(ctx, cli, ops); err != nil {
+		_, _ = cli.Revoke(context.WithoutCancel(ctx), leaseRsp.ID)
+		return 0, err
+	}
+	return leaseRsp.ID, nil
+}
+
+// commitGuarded commits ops in transactions of at most txnBatchSize ops like
+// commitBatches, each only if the guards of its ops hold, guards[i] belongs to
+// ops[i]. The first transaction must also pass first. It returns the number of ops
+// committed and the revision of the last transaction, a failure leaves the batches
+// before it applied.
+func commitGuarded(ctx context.Context, cli *clientv3.Client, ops []clientv3.Op, guards []clientv3.Cmp, first ...clientv3.Cmp) (done int, rev int64, err error) {
+	for done < len(ops) {
+		end := min(len(ops), done+txnBatchSize)
+		cmps := slices.Clone(guards[done:end])
+		if done == 0 {
+			cmps = append(cmps, first...)
+		}
+
+		txnRsp, err := cli.Txn(ctx).If(cmps...).Then(ops[done:end]...).Commit()
+		if err != nil {
+			return done, rev, err
+		}
+		if !txnRsp.Succeeded {
+			return done, rev, errKeysChanged
+		}
+		done, rev = end, txnRsp.Header.Revision
+	}
+	return done, rev, nil
+}
+
+// modifiedBefore compares that the key of op was not modified at or after rev.
+func modifiedBefore(op clientv3.Op, rev int64) clientv3.Cmp {
+	return clientv3.Compare(clientv3.ModRevision(string(op.KeyBytes())), "<", rev)
+}
+
+// commitBatches commits ops in transactions of at most txnBatchSize ops.
+func commitBatches(ctx context.Context, cli *clientv3.Client, ops []clientv3.Op) error {
+	for len(ops) > 0 {
+		n := min(len(ops), txnBatchSize)
+		if _, err := cli.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return err
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+func (h *v3Handlers) Trash(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	if cf.Trash.Prefix == "" {
+		Rsp{"errorCode": 404, "message": "The trash is not enabled."}.WriteTo(w)
+		return
+	}
+
+	ctx := r.Context()
+	getRsp, err := cli.Get(ctx, cf.Trash.metaKey(cli.Username, ""), clientv3.WithPrefix())
+	if err != nil {
+		Rsp{"errorCode": 500, "message": "get trash failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	entries := make([]trashEntry, 0, len(getRsp.Kvs))
+	for _, kv := range getRsp.Kvs {
+		var e trashEntry
+		if err := json.Unmarshal(kv.Value, &e); err != nil {
+			olog.Warnf("invalid trash entry %s: %v", kv.Key, err)
+			continue
+		}
+
+		// entries of keys the user may no longer read are hidden
+		ok, err := e.readable(ctx, cli.Client)
+		if err != nil {
+			Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+			return
+		}
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+
+	// newest first
+	slices.Reverse(entries)
+	Rsp{"entries": entries}.WriteTo(w)
+}
+
+func (h *v3Handlers) RestoreTrash(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	id := r.FormValue("id")
+	overwrite := r.FormValue("overwrite") == "true"
+
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method": r.Method,
+		"host":   cli.Host,
+		"uname":  cli.Username,
+		"id":     id,
+	})
+
+	logger.Debug("RESTORE TRASH v3")
+
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	if cf.Trash.Prefix == "" {
+		Rsp{"errorCode": 404, "message": "The trash is not enabled."}.WriteTo(w)
+		return
+	}
+
+	ctx := r.Context()
+	metaRsp, err := cli.Get(ctx, cf.Trash.metaKey(cli.Username, id))
+	if err != nil {
+		Rsp{"errorCode": 500, "message": "get trash failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+	if id == "" || len(metaRsp.Kvs) == 0 {
+		Rsp{"errorCode": 404, "message": "The trash entry does not exist."}.WriteTo(w)
+		return
+	}
+
+	var e trashEntry
+	if err := json.Unmarshal(metaRsp.Kvs[0].Value, &e); err != nil {
+		Rsp{"errorCode": 500, "message": "invalid trash entry: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	if ok, err := e.readable(ctx, cli.Client); err != nil {
+		Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+		return
+	} else if !ok {
+		Rsp{"errorCode": 403, "message": "You are not allowed to read the deleted keys."}.WriteTo(w)
+		return
+	}
+
+	// keys are restored only if they did not change after this revision
+	rev := metaRsp.Header.Revision
+	prefix := cf.Trash.dataPrefix(cli.Username, id)
+	var ops []clientv3.Op
+	var conflicts []string
+	var existing map[string]bool
+	if !overwrite {
+		existing, err = e.existingKeys(ctx, cli.Client)
+		if err != nil {
+			Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+			return
+		}
+	}
+
+	kr := keyRange{from: prefix, end: clientv3.GetPrefixRangeEnd(prefix)}
+	_, serr := scanRanges(ctx, cli.Client, []keyRange{kr}, "", func(kv *mvccpb.KeyValue) bool {
+		key := strings.TrimPrefix(string(kv.Key), prefix)
+		if cf.IsProtected(key) {
+			err = fmt.Errorf("%s is protected and must be changed through approval", key)
+			return false
+		}
+		if existing[key] {
+			conflicts = append(conflicts, key)
+		}
+		ops = append(ops, clientv3.OpPut(key, string(kv.Value)))
+		return true
+	})
+	if err != nil {
+		Rsp{"errorCode": 403, "message": err.Error()}.WriteTo(w)
+		return
+	}
+	if serr != nil {
+		Rsp{"errorCode": 500, "message": "get trash failed: " + serr.Error()}.WriteTo(w)
+		return
+	}
+
+	if len(conflicts) > 0 {
+		Rsp{"errorCode": 409, "message": "Some keys exist again, restore with overwrite to replace them.", "conflicts": conflicts}.WriteTo(w)
+		return
+	}
+
+	// restored values are checked like any other write
+	pc := newPolicyCheck(r, cli.Client, &cf)
+	var warnings []string
+	for _, op := range ops {
+		key := string(op.KeyBytes())
+		_, ws, err := cf.checkValue(key, string(op.ValueBytes()), "", "false", true)
+		if err != nil {
+			Rsp{"errorCode": 422, "message": key + ": " + err.Error()}.WriteTo(w)
+			return
+		}
+		warnings = append(warnings, ws...)
+
+		ws, err = pc.check(opPut, key, "", cf.decodeStored(key, op.ValueBytes()))
+		if err != nil {
+			logger.Infof("policy check of %s: %v", key, err)
+			writePolicyErr(w, err)
+			return
+		}
+		warnings = append(warnings, ws...)
+	}
+
+	guards := make([]clientv3.Cmp, len(ops))
+	for i, op := range ops {
+		guards[i] = modifiedBefore(op, rev+1)
+	}
+	if n, _, err := commitGuarded(ctx, cli.Client, ops, guards); err != nil {
+		logger.Warnf("restore failed after %d of %d keys: %v", n, len(ops), err)
+		code := 500
+		if errors.Is(err, errKeysChanged) {
+			code = 409
+		}
+		msg := "restore failed: " + err.Error()
+		if n > 0 {
+			msg = fmt.Sprintf("restore failed after %d of %d keys: %v. The trash entry is kept, "+
+				"restore it again with overwrite to finish.", n, len(ops), err)
+		}
+		Rsp{"errorCode": code, "message": msg, "restored": n}.WriteTo(w)
+		return
+	}
+
+	if _, err := cli.Revoke(ctx, clientv3.LeaseID(metaRsp.Kvs[0].Lease)); err != nil {
+		logger.Warnf("remove trash entry: %v", err)
+	}
+
+	logger.Infof("restored %d keys of %s", len(ops), e.Key)
+	rsp := Rsp{"status": "ok", "total": len(ops)}
+	if len(warnings) > 0 {
+		rsp["warnings"] = warnings
+	}
+	rsp.WriteTo(w)
+}
+
+func (h *v3Handlers) PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	id := r.FormValue("id")
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	if cf.Trash.Prefix == "" {
+		Rsp{"errorCode": 404, "message": "The trash is not enabled."}.WriteTo(w)
+		return
+	}
+
+	ctx := r.Context()
+	metaRsp, err := cli.Get(ctx, cf.Trash.metaKey(cli.Username, id))
+	if err != nil {
+		Rsp{"errorCode": 500, "message": "get trash failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+	if id == "" || len(metaRsp.Kvs) == 0 {
+		Rsp{"errorCode": 404, "message": "The trash entry does not exist."}.WriteTo(w)
+		return
+	}
+
+	if _, err := cli.Revoke(ctx, clientv3.LeaseID(metaRsp.Kvs[0].Lease)); err != nil {
+		Rsp{"errorCode": 500, "message": "remove trash entry failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+	Rsp{"status": "ok"}.WriteTo(w)
+}
+
+// ranges returns the key ranges the entry was deleted from.
+func (e *trashEntry) ranges() []keyRange {
+	if e.Dir {
+		return []keyRange{{from: e.Key, end: clientv3.GetPrefixRangeEnd(e.Key)}}
+	}
+
+	keys := e.Keys
+	if len(keys) == 0 {
+		keys = []string{e.Key}
+	}
+	ranges := make([]keyRange, len(keys))
+	for i, key := range keys {
+		ranges[i] = keyRange{from: key, end: key + "\x00"}
+	}
+	return ranges
+}
+
+// readable reports whether the client may read every key the entry was deleted
+// from, its values must not be shown to users who lost the permission.
+func (e *trashEntry) readable(ctx context.Context, cli *clientv3.Client) (bool, error) {
+	for _, kr := range e.ranges() {
+		_, err := cli.Get(ctx, keyOrMin(kr.from), clientv3.WithRange(kr.end), clientv3.WithCountOnly())
+		if errors.Is(err, rpctypes.ErrPermissionDenied) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// existingKeys returns the keys that exist again where the entry was deleted from.
+func (e *trashEntry) existingKeys(ctx context.Context, cli *clientv3.Client) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	_, err := scanRanges(ctx, cli, e.ranges(), "", func(kv *mvccpb.KeyValue) bool {
+		keys[string(kv.Key)] = true
+		return true
+	}, clientv3.WithKeysOnly())
+	return keys, err
+}
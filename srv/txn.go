@@ -0,0 +1,325 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/welllog/olog"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// txnReq describes an etcd transaction: If(Compare...).Then(Success...).Else(Failure...).
+type txnReq struct {
+	Compare []txnCmp `json:"compare"`
+	Success []txnOp  `json:"success"`
+	Failure []txnOp  `json:"failure"`
+}
+
+type txnCmp struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"rangeEnd"`
+	Prefix   bool   `json:"prefix"`
+	// Target is one of value, version, create, mod, lease.
+	Target string `json:"target"`
+	// Result is one of =, !=, <, >.
+	Result string          `json:"result"`
+	Value  json.RawMessage `json:"value"`
+}
+
+type txnOp struct {
+	// Op is one of put, get, delete.
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	RangeEnd string `json:"rangeEnd"`
+	Prefix   bool   `json:"prefix"`
+	Value    string `json:"value"`
+	// Format overrides the configured or detected format of a put value.
+	Format string `json:"format"`
+	// Raw stores a put value as is instead of encoding it with the configured codec.
+	Raw       bool  `json:"raw"`
+	Lease     int64 `json:"lease"`
+	Limit     int64 `json:"limit"`
+	KeysOnly  bool  `json:"keysOnly"`
+	CountOnly bool  `json:"countOnly"`
+	PrevKv    bool  `json:"prevKv"`
+}
+
+type txnKv struct {
+	Key            string `json:"key"`
+	Value          string `json:"value,omitempty"`
+	Encoding       string `json:"encoding,omitempty"`
+	Codec          string `json:"codec,omitempty"`
+	CreateRevision int64  `json:"createRevision"`
+	ModRevision    int64  `json:"modRevision"`
+	Version        int64  `json:"version"`
+	Lease          int64  `json:"lease,omitempty"`
+}
+
+type txnOpRsp struct {
+	Op      string  `json:"op"`
+	Kvs     []txnKv `json:"kvs,omitempty"`
+	PrevKvs []txnKv `json:"prevKvs,omitempty"`
+	Count   int64   `json:"count,omitempty"`
+	Deleted int64   `json:"deleted,omitempty"`
+	More    bool    `json:"more,omitempty"`
+}
+
+func (h *v3Handlers) Txn(w http.ResponseWriter, r *http.Request) {
+	cli, release, abort := h.getCli(w, r)
+	if abort {
+		return
+	}
+	defer release()
+
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"method": r.Method,
+		"host":   cli.Host,
+		"uname":  cli.Username,
+	})
+
+	logger.Debug("TXN v3")
+
+	var req txnReq
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8*MB)).Decode(&req); err != nil {
+		Rsp{"errorCode": 400, "message": "parse txn failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	cmps := make([]clientv3.Cmp, len(req.Compare))
+	for i, c := range req.Compare {
+		cmp, err := c.build()
+		if err != nil {
+			Rsp{"errorCode": 400, "message": fmt.Sprintf("compare %d: %v", i, err)}.WriteTo(w)
+			return
+		}
+		cmps[i] = cmp
+	}
+
+	cf, _ := h.conf.Load().GetEtcdConfig(cli.Host)
+	thenOps, warnings, err := buildTxnOps(req.Success, cf)
+	if err != nil {
+		Rsp{"errorCode": 400, "message": "success " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	elseOps, ws, err := buildTxnOps(req.Failure, cf)
+	if err != nil {
+		Rsp{"errorCode": 400, "message": "failure " + err.Error()}.WriteTo(w)
+		return
+	}
+	warnings = append(warnings, ws...)
+
+	// Policies are checked for both branches, as it is not known which one runs.
+	ctx := r.Context()
+	pc := newPolicyCheck(r, cli.Client, &cf)
+	for _, o := range append(req.Success, req.Failure...) {
+		if o.Op != opPut && o.Op != opDelete {
+			continue
+		}
+		if o.Op == opPut {
+			if ro, err := isKubernetesObject(ctx, cli.Client, &cf, o.Key); err != nil {
+				logger.Warnf("get failed: %v", err)
+				Rsp{"errorCode": 500, "message": "get failed: " + err.Error()}.WriteTo(w)
+				return
+			} else if ro {
+				Rsp{"errorCode": 403, "message": "Kubernetes objects are read-only, " + o.Key + " can not be put."}.WriteTo(w)
+				return
+			}
+		}
+		ws, err := pc.check(o.Op, o.Key, o.rangeEnd(), o.Value)
+		if err != nil {
+			logger.Infof("policy check of %s: %v", o.Key, err)
+			writePolicyErr(w, err)
+			return
+		}
+		warnings = append(warnings, ws...)
+	}
+
+	txnRsp, err := cli.Txn(ctx).If(cmps...).Then(thenOps...).Else(elseOps...).Commit()
+	if err != nil {
+		logger.Warnf("txn failed: %v", err)
+		Rsp{"errorCode": 500, "message": "txn failed: " + err.Error()}.WriteTo(w)
+		return
+	}
+
+	ops := req.Success
+	if !txnRsp.Succeeded {
+		ops = req.Failure
+	}
+
+	rsps := make([]txnOpRsp, len(txnRsp.Responses))
+	for i, rsp := range txnRsp.Responses {
+		rsps[i] = newTxnOpRsp(&cf, ops[i].Op, rsp)
+	}
+
+	rsp := Rsp{
+		"succeeded": txnRsp.Succeeded,
+		"revision":  txnRsp.Header.Revision,
+		"responses": rsps,
+	}
+	if len(warnings) > 0 {
+		rsp["warnings"] = warnings
+	}
+	rsp.WriteTo(w)
+}
+
+func (c txnCmp) build() (clientv3.Cmp, error) {
+	if c.Result != "=" && c.Result != "!=" && c.Result != "<" && c.Result != ">" {
+		return clientv3.Cmp{}, fmt.Errorf("unknown result %q", c.Result)
+	}
+
+	var cmp clientv3.Cmp
+	if c.Target == "value" {
+		var v string
+		if err := json.Unmarshal(c.Value, &v); err != nil {
+			return cmp, fmt.Errorf("value must be a string: %w", err)
+		}
+		cmp = clientv3.Compare(clientv3.Value(c.Key), c.Result, v)
+	} else {
+		n, err := strconv.ParseInt(strings.Trim(string(c.Value), `"`), 10, 64)
+		if err != nil {
+			return cmp, fmt.Errorf("%s must be a number: %w", c.Target, err)
+		}
+
+		switch c.Target {
+		case "version":
+			cmp = clientv3.Compare(clientv3.Version(c.Key), c.Result, n)
+		case "create":
+			cmp = clientv3.Compare(clientv3.CreateRevision(c.Key), c.Result, n)
+		case "mod":
+			cmp = clientv3.Compare(clientv3.ModRevision(c.Key), c.Result, n)
+		case "lease":
+			cmp = clientv3.Compare(clientv3.LeaseValue(c.Key), c.Result, n)
+		default:
+			return cmp, fmt.Errorf("unknown target %q", c.Target)
+		}
+	}
+
+	if c.Prefix {
+		return cmp.WithPrefix(), nil
+	}
+	if c.RangeEnd != "" {
+		return cmp.WithRange(c.RangeEnd), nil
+	}
+	return cmp, nil
+}
+
+// rangeEnd returns the end of the key range of the op, empty for a single key.
+func (o txnOp) rangeEnd() string {
+	if o.Prefix {
+		return clientv3.GetPrefixRangeEnd(o.Key)
+	}
+	return o.RangeEnd
+}
+
+// buildTxnOps converts ops, it returns the format warnings of put values.
+func buildTxnOps(ops []txnOp, cf Etcd) ([]clientv3.Op, []string, error) {
+	list := make([]clientv3.Op, len(ops))
+	var warnings []string
+	for i, o := range ops {
+		var opts []clientv3.OpOption
+		end := o.rangeEnd()
+		if o.Prefix {
+			opts = append(opts, clientv3.WithPrefix())
+		} else if o.RangeEnd != "" {
+			opts = append(opts, clientv3.WithRange(o.RangeEnd))
+		}
+
+		switch o.Op {
+		case "get":
+			if o.Limit > 0 {
+				opts = append(opts, clientv3.WithLimit(o.Limit))
+			}
+			if o.KeysOnly {
+				opts = append(opts, clientv3.WithKeysOnly())
+			}
+			if o.CountOnly {
+				opts = append(opts, clientv3.WithCountOnly())
+			}
+			list[i] = clientv3.OpGet(o.Key, opts...)
+		case opPut:
+			if cf.IsProtected(o.Key) {
+				return nil, nil, fmt.Errorf("op %d: %s is protected and must be changed through approval", i, o.Key)
+			}
+			value, ws, err := cf.checkValue(o.Key, o.Value, o.Format, "", o.Raw)
+			if err != nil {
+				return nil, nil, fmt.Errorf("op %d: %w", i, err)
+			}
+			warnings = append(warnings, ws...)
+			if !o.Raw {
+				if value, err = cf.encodeStored(o.Key, value); err != nil {
+					return nil, nil, fmt.Errorf("op %d: %w", i, err)
+				}
+			}
+			opts = opts[:0]
+			if o.Lease > 0 {
+				opts = append(opts, clientv3.WithLease(clientv3.LeaseID(o.Lease)))
+			}
+			if o.PrevKv {
+				opts = append(opts, clientv3.WithPrevKV())
+			}
+			list[i] = clientv3.OpPut(o.Key, value, opts...)
+		case opDelete:
+			if cf.OverlapsProtected(o.Key, end) {
+				return nil, nil, fmt.Errorf("op %d: %s touches protected keys which must be changed through approval", i, o.Key)
+			}
+			if cf.Trash.touches(o.Key, end) {
+				return nil, nil, fmt.Errorf("op %d: %s touches keys of the trash, they expire after the retention period", i, o.Key)
+			}
+			if cf.Trash.Prefix != "" {
+				// the deleted keys of a transaction are only known once it ran
+				return nil, nil, fmt.Errorf("op %d: deletes can not be kept in the trash in a transaction, delete %s from the tree", i, o.Key)
+			}
+			if o.PrevKv {
+				opts = append(opts, clientv3.WithPrevKV())
+			}
+			list[i] = clientv3.OpDelete(o.Key, opts...)
+		default:
+			return nil, nil, fmt.Errorf("op %d: unknown op %q", i, o.Op)
+		}
+	}
+	return list, warnings, nil
+}
+
+func newTxnOpRsp(cf *Etcd, op string, rsp *etcdserverpb.ResponseOp) txnOpRsp {
+	or := txnOpRsp{Op: op}
+	switch v := rsp.Response.(type) {
+	case *etcdserverpb.ResponseOp_ResponseRange:
+		or.Kvs = newTxnKvs(cf, v.ResponseRange.Kvs)
+		or.Count = v.ResponseRange.Count
+		or.More = v.ResponseRange.More
+	case *etcdserverpb.ResponseOp_ResponsePut:
+		if v.ResponsePut.PrevKv != nil {
+			or.PrevKvs = newTxnKvs(cf, []*mvccpb.KeyValue{v.ResponsePut.PrevKv})
+		}
+	case *etcdserverpb.ResponseOp_ResponseDeleteRange:
+		or.Deleted = v.ResponseDeleteRange.Deleted
+		or.PrevKvs = newTxnKvs(cf, v.ResponseDeleteRange.PrevKvs)
+	}
+	return or
+}
+
+// newTxnKvs converts kvs, decoding their values as the editor shows them.
+func newTxnKvs(cf *Etcd, kvs []*mvccpb.KeyValue) []txnKv {
+	list := make([]txnKv, len(kvs))
+	for i, kv := range kvs {
+		n := Node{Key: string(kv.Key)}
+		n.setValue(cf, kv.Value)
+		list[i] = txnKv{
+			Key:            n.Key,
+			Value:          n.Value,
+			Encoding:       n.Encoding,
+			Codec:          n.Codec,
+			CreateRevision: kv.CreateRevision,
+			ModRevision:    kv.ModRevision,
+			Version:        kv.Version,
+			Lease:          kv.Lease,
+		}
+	}
+	return list
+}
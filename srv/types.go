@@ -1,14 +1,33 @@
 package srv
 
 import (
+	"encoding/base64"
+	"encoding/gob"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/welllog/golib/strz"
+	"github.com/welllog/olog"
 )
 
+// userInfo is the login of a user to a host kept in the session, Secret is the
+// password encrypted by the credentialCipher of the handlers.
 type userInfo struct {
-	Host   string
-	Name   string
-	Passwd string
+	Host string
+	Name string
+	// Cluster is set when Host names a configured cluster instead of listing
+	// endpoints, the name must not be dialed once the cluster is removed.
+	Cluster bool
+	Secret  []byte
+}
+
+func init() {
+	// session providers that persist sessions encode their values with gob
+	gob.Register(&userInfo{})
+	gob.Register(&draft{})
 }
 
 type Rsp map[string]any
@@ -30,11 +49,68 @@ type Node struct {
 	ModifiedIndex int64   `json:"modifiedIndex,omitempty"`
 	VersionIndex  int64   `json:"versionIndex,omitempty"`
 	Ttl           int64   `json:"ttl,omitempty"`
+	Encoding      string  `json:"encoding,omitempty"`
+	Codec         string  `json:"codec,omitempty"`
+	Format        string  `json:"format,omitempty"`
+	ReadOnly      bool    `json:"readOnly,omitempty"`
+	Count         int64   `json:"count,omitempty"`
 	Nodes         []*Node `json:"nodes,omitempty"`
 }
 
+// encodingBase64 marks values transported as standard base64 because they are
+// not valid UTF-8 and would be corrupted by the JSON encoder.
+const encodingBase64 = "base64"
+
+// setValue fills the value of the node, decoding values the editor can not show as is.
+// The key of the node selects the codec configured in cf.
+func (n *Node) setValue(cf *Etcd, value []byte) {
+	if name, c, ok := cf.CodecFor(n.Key); ok {
+		if b, err := c.Decode(value); err == nil {
+			value = b
+			n.Codec = name
+		} else {
+			olog.Debugf("decode %s with %s failed: %v", n.Key, name, err)
+		}
+	}
+
+	// other values may start with the magic of kube-apiserver by chance
+	if strings.HasPrefix(n.Key, cf.KubernetesPrefix) && isKubernetesValue(value) {
+		if s, err := decodeKubernetes(value); err == nil {
+			n.Value = s
+			n.Format = formatKubernetes
+			n.ReadOnly = true
+			return
+		}
+	}
+
+	if !utf8.Valid(value) {
+		n.Value = base64.StdEncoding.EncodeToString(value)
+		n.Encoding = encodingBase64
+		return
+	}
+
+	n.Value = strz.UnsafeString(value)
+}
+
+// decodeValue decodes a value received with the given transport encoding.
+func decodeValue(value, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case encodingBase64:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", err
+		}
+		return strz.UnsafeString(b), nil
+	default:
+		return "", fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
 type NodeRsp struct {
-	Node Node `json:"node"`
+	Node     Node     `json:"node"`
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 func (n NodeRsp) WriteTo(w http.ResponseWriter) {
@@ -43,15 +119,18 @@ func (n NodeRsp) WriteTo(w http.ResponseWriter) {
 
 type NodesRsp struct {
 	Nodes []*Node `json:"nodes"`
+	Next  string  `json:"next,omitempty"`
 }
 
 func (n NodesRsp) WriteTo(w http.ResponseWriter) {
 	JsonRsp(w, n)
 }
 
+// HostInfo is a configured cluster, Host is what the page connects to.
 type HostInfo struct {
-	Host string `json:"host"`
-	Name string `json:"name"`
+	Host      string `json:"host"`
+	Name      string `json:"name"`
+	Endpoints string `json:"endpoints"`
 }
 
 type keyRange struct {
@@ -1,12 +1,15 @@
 package srv
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/pkg/v3/transport"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
@@ -54,6 +57,19 @@ func isEtcdServerErr(err error) bool {
 	return strings.Contains(err.Error(), "etcdserver:")
 }
 
+// checkEtcdClient fails for clients that can not reach their endpoints or whose
+// user can no longer authenticate, a user lacking permissions is healthy.
+// A revoked or expired auth token is not detected as such: the client
+// authenticates again with its stored password when etcd rejects the token, so
+// only a changed password or a removed user fails the check.
+func checkEtcdClient(ctx context.Context, cli *clientv3.Client) error {
+	_, err := cli.AuthStatus(ctx)
+	if err == nil || errors.Is(err, rpctypes.ErrPermissionDenied) {
+		return nil
+	}
+	return err
+}
+
 func newEtcdClient(name, passwd string, cf Etcd) (*clientv3.Client, error) {
 	var tlsConfig *tls.Config
 	if cf.Tls.Enable {
@@ -70,7 +86,8 @@ func newEtcdClient(name, passwd string, cf Etcd) (*clientv3.Client, error) {
 	}
 
 	conf := clientv3.Config{
-		Endpoints:            []string{cf.Endpoints},
+		Endpoints:            cf.Endpoints,
+		AutoSyncInterval:     time.Duration(cf.AutoSyncInterval) * time.Second,
 		DialTimeout:          10 * time.Second,
 		TLS:                  tlsConfig,
 		DialKeepAliveTime:    time.Minute,
@@ -0,0 +1,431 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/welllog/olog"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	webhookQueueSize         = 1024
+	webhookDefaultRetries    = 5
+	webhookDefaultTimeout    = 10
+	webhookInitialBackoff    = time.Second
+	webhookMaxBackoff        = time.Minute
+	webhookSignatureHeader   = "X-Etcdkeeper-Signature"
+	webhookEventHeader       = "X-Etcdkeeper-Event"
+	webhookDeliveryHeader    = "X-Etcdkeeper-Delivery"
+	webhookDefaultDeadLetter = "./webhook-dead-letter.jsonl"
+)
+
+// WebhookConf posts the changes of keys under Prefix to URL.
+type WebhookConf struct {
+	Name   string `yaml:"name"`
+	Prefix string `yaml:"prefix"`
+	URL    string `yaml:"url"`
+	// Secret signs the payload with HMAC-SHA256, the hex digest is sent as
+	// "sha256=<digest>" in the X-Etcdkeeper-Signature header.
+	Secret string `yaml:"secret"`
+	// Username and Password are used to watch the prefix if etcd has auth enabled.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// MaxRetries is the number of retries of a failed delivery before it is
+	// written to the dead letter file.
+	MaxRetries int `yaml:"maxRetries"`
+	// Timeout of a delivery in seconds.
+	Timeout int `yaml:"timeout"`
+}
+
+func (wc *WebhookConf) Default() {
+	if wc.MaxRetries <= 0 {
+		wc.MaxRetries = webhookDefaultRetries
+	}
+	if wc.Timeout <= 0 {
+		wc.Timeout = webhookDefaultTimeout
+	}
+}
+
+// webhookEvent is the payload posted to webhooks. Values that are not valid
+// UTF-8 are sent as standard base64 and Encoding is set.
+type webhookEvent struct {
+	Cluster        string `json:"cluster"`
+	Webhook        string `json:"webhook"`
+	Type           string `json:"type"`
+	Key            string `json:"key"`
+	Value          string `json:"value,omitempty"`
+	OldValue       string `json:"oldValue,omitempty"`
+	Encoding       string `json:"encoding,omitempty"`
+	Revision       int64  `json:"revision"`
+	CreateRevision int64  `json:"createRevision,omitempty"`
+	Version        int64  `json:"version,omitempty"`
+	Lease          int64  `json:"lease,omitempty"`
+}
+
+// deadLetter is written to the dead letter file for deliveries that failed.
+type deadLetter struct {
+	Time     string       `json:"time"`
+	URL      string       `json:"url"`
+	Delivery string       `json:"delivery"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	Event    webhookEvent `json:"event"`
+}
+
+// webhookDispatcher watches the prefixes of the configured webhooks and delivers
+// their events in order, one queue per webhook.
+type webhookDispatcher struct {
+	hooks      []*webhook
+	deadLetter string
+	dlMu       sync.Mutex
+	backoff    time.Duration
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+type webhook struct {
+	conf   WebhookConf
+	etcd   Etcd
+	queue  chan webhookEvent
+	client *http.Client
+	// rev is the revision of the last watch response queued, the watch resumes
+	// after it.
+	rev atomic.Int64
+}
+
+// newWebhookDispatcher creates the webhooks of cf. Their etcd clients are created
+// once they start watching, an unreachable cluster does not keep the server from
+// starting or reloading.
+func newWebhookDispatcher(cf Conf) *webhookDispatcher {
+	d := &webhookDispatcher{deadLetter: cf.WebhookDeadLetter, backoff: webhookInitialBackoff}
+	if d.deadLetter == "" {
+		d.deadLetter = webhookDefaultDeadLetter
+	}
+
+	for _, e := range cf.Etcds {
+		for _, wc := range e.Webhooks {
+			wc.Default()
+			d.hooks = append(d.hooks, &webhook{
+				conf:   wc,
+				etcd:   e,
+				queue:  make(chan webhookEvent, webhookQueueSize),
+				client: &http.Client{Timeout: time.Duration(wc.Timeout) * time.Second},
+			})
+		}
+	}
+	return d
+}
+
+// resumeFrom makes the webhooks also kept by old watch after the last revision old
+// queued, so the changes made while a reload replaces old are delivered. old must
+// be stopped.
+func (d *webhookDispatcher) resumeFrom(old *webhookDispatcher) {
+	for _, wh := range d.hooks {
+		for _, o := range old.hooks {
+			if o.etcd.Name != wh.etcd.Name || o.conf.Name != wh.conf.Name || o.conf.Prefix != wh.conf.Prefix ||
+				!slices.Equal(o.etcd.Endpoints, wh.etcd.Endpoints) {
+				continue
+			}
+			if rev := o.rev.Load(); rev > 0 {
+				wh.rev.Store(rev)
+			}
+			break
+		}
+	}
+}
+
+// Start watches the prefixes of all webhooks until Stop is called.
+func (d *webhookDispatcher) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+
+	for _, wh := range d.hooks {
+		olog.Infof("webhook %s watches %s of %s", wh.conf.Name, wh.conf.Prefix, wh.etcd.Name)
+
+		d.wg.Add(2)
+		go func(wh *webhook) {
+			defer d.wg.Done()
+			defer close(wh.queue)
+			d.watch(ctx, wh)
+		}(wh)
+
+		go func(wh *webhook) {
+			defer d.wg.Done()
+			for ev := range wh.queue {
+				d.deliver(ctx, wh, ev)
+			}
+		}(wh)
+	}
+}
+
+// Stop stops watching and waits until the queued events are delivered or ctx is
+// done. Queued events are tried once, failures are written to the dead letter file.
+func (d *webhookDispatcher) Stop(ctx context.Context) {
+	if d.cancel == nil {
+		return
+	}
+	d.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		olog.Warn("webhooks stop timeout")
+	}
+}
+
+// connect creates the etcd client of wh, retrying with exponential backoff until
+// it succeeds or ctx is done, in which case it returns nil.
+func (d *webhookDispatcher) connect(ctx context.Context, wh *webhook, logger olog.Logger) *clientv3.Client {
+	backoff := d.backoff
+	for {
+		cli, err := newEtcdClient(wh.conf.Username, wh.conf.Password, wh.etcd)
+		if err == nil {
+			if ctx.Err() != nil {
+				_ = cli.Close()
+				return nil
+			}
+			return cli
+		}
+
+		logger.Warnf("connect failed, retry in %s: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// prefixRevision returns the current revision of the cluster, read from the
+// prefix a webhook user is allowed to read.
+func prefixRevision(ctx context.Context, cli *clientv3.Client, prefix string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rsp, err := cli.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return rsp.Header.Revision, nil
+}
+
+// watch watches the prefix of wh after the revision it was resumed at, or after the
+// revision of its first connection. It resumes after the last queued revision when
+// the watch fails. The events of a response are queued together, a response cut
+// short by Stop is queued again by the dispatcher resuming from this one.
+func (d *webhookDispatcher) watch(ctx context.Context, wh *webhook) {
+	logger := olog.WithEntries(olog.GetLogger(), map[string]any{
+		"webhook": wh.conf.Name,
+		"host":    wh.etcd.Name,
+	})
+
+	cli := d.connect(ctx, wh, logger)
+	if cli == nil {
+		return
+	}
+	defer cli.Close()
+
+	if wh.rev.Load() == 0 {
+		// changes made between now and the first watch are delivered too
+		if rev, err := prefixRevision(ctx, cli, wh.conf.Prefix); err != nil {
+			logger.Warnf("read revision failed, watch from the revision of the first watch: %v", err)
+		} else {
+			wh.rev.Store(rev)
+		}
+	}
+
+	for ctx.Err() == nil {
+		opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV()}
+		if rev := wh.rev.Load(); rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev+1))
+		}
+
+		for wr := range cli.Watch(clientv3.WithRequireLeader(ctx), wh.conf.Prefix, opts...) {
+			if err := wr.Err(); err != nil {
+				if errors.Is(err, rpctypes.ErrCompacted) {
+					logger.Warnf("events before revision %d are compacted and lost", wr.CompactRevision)
+					wh.rev.Store(wr.CompactRevision - 1)
+				} else {
+					logger.Warnf("watch failed: %v", err)
+				}
+				break
+			}
+
+			for _, ev := range wr.Events {
+				select {
+				case wh.queue <- wh.newEvent(ev):
+				case <-ctx.Done():
+					return
+				}
+			}
+			if n := len(wr.Events); n > 0 {
+				wh.rev.Store(wr.Events[n-1].Kv.ModRevision)
+			}
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (wh *webhook) newEvent(ev *clientv3.Event) webhookEvent {
+	e := webhookEvent{
+		Cluster:  wh.etcd.Name,
+		Webhook:  wh.conf.Name,
+		Type:     "put",
+		Key:      string(ev.Kv.Key),
+		Revision: ev.Kv.ModRevision,
+	}
+
+	var value, oldValue []byte
+	if ev.Type == mvccpb.DELETE {
+		e.Type = "delete"
+	} else {
+		e.CreateRevision = ev.Kv.CreateRevision
+		e.Version = ev.Kv.Version
+		e.Lease = ev.Kv.Lease
+		value = []byte(wh.etcd.decodeStored(e.Key, ev.Kv.Value))
+	}
+	if ev.PrevKv != nil {
+		oldValue = []byte(wh.etcd.decodeStored(e.Key, ev.PrevKv.Value))
+	}
+
+	if utf8.Valid(value) && utf8.Valid(oldValue) {
+		e.Value, e.OldValue = string(value), string(oldValue)
+	} else {
+		e.Value = base64.StdEncoding.EncodeToString(value)
+		e.OldValue = base64.StdEncoding.EncodeToString(oldValue)
+		e.Encoding = encodingBase64
+	}
+	return e
+}
+
+// deliver posts ev to the webhook, retrying with exponential backoff. Events that
+// can not be delivered are written to the dead letter file.
+func (d *webhookDispatcher) deliver(ctx context.Context, wh *webhook, ev webhookEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		olog.Errorf("webhook %s marshal event: %v", wh.conf.Name, err)
+		return
+	}
+
+	delivery := newDeliveryID()
+	backoff := d.backoff
+	attempts := 0
+	for {
+		attempts++
+		retry, err := wh.post(ctx, delivery, ev.Type, body)
+		if err == nil {
+			olog.Debugf("webhook %s delivered %s %s at revision %d", wh.conf.Name, ev.Type, ev.Key, ev.Revision)
+			return
+		}
+
+		olog.Warnf("webhook %s delivery %s attempt %d failed: %v", wh.conf.Name, delivery, attempts, err)
+		if !retry || attempts > wh.conf.MaxRetries || ctx.Err() != nil {
+			d.writeDeadLetter(deadLetter{
+				Time:     time.Now().Format(time.RFC3339),
+				URL:      wh.conf.URL,
+				Delivery: delivery,
+				Attempts: attempts,
+				Error:    err.Error(),
+				Event:    ev,
+			})
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+// post sends one delivery, retry reports whether a failure is worth retrying.
+func (wh *webhook) post(ctx context.Context, delivery, typ string, body []byte) (retry bool, err error) {
+	// deliveries in progress are finished on shutdown, the client timeout bounds them
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodPost, wh.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "etcdkeeper-webhook")
+	req.Header.Set(webhookEventHeader, typ)
+	req.Header.Set(webhookDeliveryHeader, delivery)
+	if wh.conf.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.conf.Secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*KB))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+func (d *webhookDispatcher) writeDeadLetter(dl deadLetter) {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		olog.Errorf("marshal dead letter: %v", err)
+		return
+	}
+
+	d.dlMu.Lock()
+	defer d.dlMu.Unlock()
+
+	f, err := os.OpenFile(d.deadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		olog.Errorf("open dead letter file %s: %v, lost event: %s", d.deadLetter, err, b)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		olog.Errorf("write dead letter file %s: %v, lost event: %s", d.deadLetter, err, b)
+	}
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,245 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func newTestDispatcher(t *testing.T) *webhookDispatcher {
+	t.Helper()
+	return &webhookDispatcher{
+		deadLetter: filepath.Join(t.TempDir(), "dead-letter.jsonl"),
+		backoff:    time.Millisecond,
+	}
+}
+
+func newTestWebhook(url, secret string, retries int) *webhook {
+	wc := WebhookConf{Name: "test", Prefix: "/app/", URL: url, Secret: secret, MaxRetries: retries}
+	wc.Default()
+	return &webhook{
+		conf:   wc,
+		etcd:   Etcd{Name: "default"},
+		client: &http.Client{Timeout: time.Second},
+	}
+}
+
+func readDeadLetters(t *testing.T, d *webhookDispatcher) []deadLetter {
+	t.Helper()
+	f, err := os.Open(d.deadLetter)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var dls []deadLetter
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var dl deadLetter
+		if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+			t.Fatalf("dead letter %q: %v", sc.Text(), err)
+		}
+		dls = append(dls, dl)
+	}
+	return dls
+}
+
+func TestWebhookDeliverSigned(t *testing.T) {
+	const secret = "s3cret"
+	var got webhookEvent
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get(webhookSignatureHeader) != want {
+			t.Errorf("signature %q, want %q", r.Header.Get(webhookSignatureHeader), want)
+		}
+		if r.Header.Get(webhookEventHeader) != "put" {
+			t.Errorf("event header %q, want put", r.Header.Get(webhookEventHeader))
+		}
+		if r.Header.Get(webhookDeliveryHeader) == "" {
+			t.Error("no delivery header")
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("unmarshal body: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	wh := newTestWebhook(srv.URL, secret, 3)
+	d.deliver(context.Background(), wh, webhookEvent{Cluster: "default", Webhook: "test", Type: "put", Key: "/app/a", Value: "1", Revision: 7})
+
+	if calls.Load() != 1 {
+		t.Fatalf("%d calls, want 1", calls.Load())
+	}
+	if got.Key != "/app/a" || got.Value != "1" || got.Revision != 7 {
+		t.Errorf("got event %+v", got)
+	}
+	if dls := readDeadLetters(t, d); len(dls) != 0 {
+		t.Errorf("%d dead letters, want none", len(dls))
+	}
+}
+
+func TestWebhookDeliverRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestDispatcher(t)
+	d.deliver(context.Background(), newTestWebhook(srv.URL, "", 5), webhookEvent{Type: "delete", Key: "/app/a"})
+
+	if calls.Load() != 3 {
+		t.Errorf("%d calls, want 3", calls.Load())
+	}
+	if dls := readDeadLetters(t, d); len(dls) != 0 {
+		t.Errorf("%d dead letters, want none", len(dls))
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		retries  int
+		attempts int
+	}{
+		{name: "retries exhausted", status: http.StatusInternalServerError, retries: 2, attempts: 3},
+		{name: "not retried", status: http.StatusBadRequest, retries: 2, attempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			d := newTestDispatcher(t)
+			d.deliver(context.Background(), newTestWebhook(srv.URL, "", tt.retries), webhookEvent{Type: "put", Key: "/app/b", Revision: 9})
+
+			if int(calls.Load()) != tt.attempts {
+				t.Errorf("%d calls, want %d", calls.Load(), tt.attempts)
+			}
+			dls := readDeadLetters(t, d)
+			if len(dls) != 1 {
+				t.Fatalf("%d dead letters, want 1", len(dls))
+			}
+			if dls[0].Attempts != tt.attempts || dls[0].URL != srv.URL || dls[0].Event.Key != "/app/b" || dls[0].Event.Revision != 9 {
+				t.Errorf("dead letter %+v", dls[0])
+			}
+		})
+	}
+}
+
+func TestWebhookNewEvent(t *testing.T) {
+	wh := newTestWebhook("", "", 0)
+
+	e := wh.newEvent(&clientv3.Event{
+		Type:   mvccpb.PUT,
+		Kv:     &mvccpb.KeyValue{Key: []byte("/app/a"), Value: []byte("new"), ModRevision: 5, CreateRevision: 3, Version: 2},
+		PrevKv: &mvccpb.KeyValue{Key: []byte("/app/a"), Value: []byte("old")},
+	})
+	if e.Type != "put" || e.Value != "new" || e.OldValue != "old" || e.Revision != 5 || e.Version != 2 || e.Encoding != "" {
+		t.Errorf("put event %+v", e)
+	}
+
+	e = wh.newEvent(&clientv3.Event{
+		Type:   mvccpb.DELETE,
+		Kv:     &mvccpb.KeyValue{Key: []byte("/app/a"), ModRevision: 6},
+		PrevKv: &mvccpb.KeyValue{Key: []byte("/app/a"), Value: []byte{0xff, 0x00}},
+	})
+	if e.Type != "delete" || e.Encoding != encodingBase64 || e.OldValue != "/wA=" {
+		t.Errorf("delete event %+v", e)
+	}
+}
+
+func TestWebhookResumeFrom(t *testing.T) {
+	hook := func(name, prefix, endpoints string, rev int64) *webhook {
+		wh := newTestWebhook("", "", 0)
+		wh.conf.Name, wh.conf.Prefix = name, prefix
+		wh.etcd.Endpoints = Endpoints{endpoints}
+		wh.rev.Store(rev)
+		return wh
+	}
+
+	old := &webhookDispatcher{hooks: []*webhook{
+		hook("kept", "/app/", "127.0.0.1:2379", 10),
+		hook("moved", "/app/", "127.0.0.1:2379", 10),
+		hook("reprefixed", "/app/", "127.0.0.1:2379", 10),
+		hook("unread", "/app/", "127.0.0.1:2379", 0),
+	}}
+	d := &webhookDispatcher{hooks: []*webhook{
+		hook("kept", "/app/", "127.0.0.1:2379", 20),
+		hook("moved", "/app/", "127.0.0.1:22379", 20),
+		hook("reprefixed", "/other/", "127.0.0.1:2379", 20),
+		hook("unread", "/app/", "127.0.0.1:2379", 20),
+		hook("added", "/app/", "127.0.0.1:2379", 20),
+	}}
+	d.resumeFrom(old)
+
+	want := map[string]int64{"kept": 10, "moved": 20, "reprefixed": 20, "unread": 20, "added": 20}
+	for _, wh := range d.hooks {
+		if got := wh.rev.Load(); got != want[wh.conf.Name] {
+			t.Errorf("webhook %s resumes after %d, want %d", wh.conf.Name, got, want[wh.conf.Name])
+		}
+	}
+}
+
+func TestWebhooksChanged(t *testing.T) {
+	base := func() *Conf {
+		return &Conf{Etcds: []Etcd{{
+			Name:      "default",
+			Endpoints: []string{"127.0.0.1:2379"},
+			Webhooks:  []WebhookConf{{Name: "hook", Prefix: "/app/", URL: "http://127.0.0.1/hook"}},
+			Codecs:    []CodecConf{{Prefix: "/app/z/", Codec: "zstd"}},
+		}}}
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Conf)
+		want   bool
+	}{
+		{name: "unchanged", change: func(*Conf) {}},
+		{name: "other cluster", change: func(c *Conf) { c.Etcds = append(c.Etcds, Etcd{Name: "other"}) }},
+		{name: "endpoints", change: func(c *Conf) { c.Etcds[0].Endpoints = []string{"127.0.0.1:22379"} }, want: true},
+		{name: "webhook", change: func(c *Conf) { c.Etcds[0].Webhooks[0].Prefix = "/" }, want: true},
+		{name: "codec", change: func(c *Conf) { c.Etcds[0].Codecs[0].Codec = "gzip" }, want: true},
+		{name: "dead letter", change: func(c *Conf) { c.WebhookDeadLetter = "dead.jsonl" }, want: true},
+	}
+
+	for _, tt := range tests {
+		cf := base()
+		tt.change(cf)
+		if got := webhooksChanged(base(), cf); got != tt.want {
+			t.Errorf("%s: changed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}